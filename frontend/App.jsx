@@ -1,11 +1,13 @@
 import React, { useState, useEffect } from 'react';
 import BarChart from './components/BarChart';
+import GoalRings from './components/GoalRings';
 import HourlyActivity from './components/HourlyActivity';
 import WeeklyHeatmap from './components/WeeklyHeatmap';
 import YearlyActivity from './components/YearlyActivity';
+import { apiUrl, currentTime, isStatic } from './api';
 
 async function fetchData(endpoint) {
-    const response = await fetch(endpoint);
+    const response = await fetch(apiUrl(endpoint));
     if (!response.ok) {
         throw new Error(`Failed to fetch ${endpoint}`);
     }
@@ -18,7 +20,7 @@ function formatMonthlyData(rawData) {
         countByDay[d.Day] = d.Count;
     });
 
-    const now = new Date();
+    const now = currentTime();
     const data = [];
 
     for (let i = 29; i >= 0; i--) {
@@ -66,12 +68,42 @@ export default function App() {
     const [monthlyData, setMonthlyData] = useState(null);
     const [focusedDate, setFocusedDate] = useState(null);
     const [error, setError] = useState(null);
+    const [lastFlushId, setLastFlushId] = useState(null);
+    const [records, setRecords] = useState(null);
     const newDayHour = window.CONFIG?.newDayHour || 0;
+    const hideHours = !!window.CONFIG?.hideHours;
 
     useEffect(() => {
         fetchData('/api/daily')
             .then(raw => setMonthlyData(formatMonthlyData(raw)))
             .catch(err => setError(err.message));
+    }, [lastFlushId]);
+
+    useEffect(() => {
+        fetchData('/api/stats')
+            .then(setRecords)
+            .catch(err => setError(err.message));
+    }, []);
+
+    useEffect(() => {
+        if (isStatic) {
+            return;
+        }
+
+        const source = new EventSource('/api/stream');
+
+        source.addEventListener('flush', e => {
+            setLastFlushId(JSON.parse(e.data).id);
+        });
+
+        source.addEventListener('today', e => {
+            const today = JSON.parse(e.data);
+            setMonthlyData(data => data && data.map(d =>
+                d.date === today.day ? { ...d, count: today.count } : d
+            ));
+        });
+
+        return () => source.close();
     }, []);
 
     const stats = calculateStats(monthlyData);
@@ -80,6 +112,7 @@ export default function App() {
         <>
             <header>
                 <h1>selfwatch</h1>
+                <GoalRings refreshKey={lastFlushId} />
                 {stats && (
                     <div className="header-stats">
                         <div className="stat-item">
@@ -96,17 +129,36 @@ export default function App() {
                                 {formatDelta(stats.weekDelta)}
                             </div>
                         </div>
+                        {records && (
+                            <div className="stat-item">
+                                <div className="stat-label">Streak</div>
+                                <div className="stat-value">{records.currentStreak.days}d</div>
+                                <div className="stat-delta">best {records.longestStreak.days}d</div>
+                            </div>
+                        )}
+                        {records?.bestDay && (
+                            <div className="stat-item">
+                                <div className="stat-label">Best Day</div>
+                                <div className="stat-value">{records.bestDay.count.toLocaleString()}</div>
+                                <div className="stat-delta">{records.bestDay.period}</div>
+                            </div>
+                        )}
                     </div>
                 )}
             </header>
 
             <main>
-                <HourlyActivity
-                    focusedDate={focusedDate}
-                    onClearFocus={() => setFocusedDate(null)}
-                />
-
-                <WeeklyHeatmap />
+                {!hideHours && (
+                    <>
+                        <HourlyActivity
+                            focusedDate={focusedDate}
+                            onClearFocus={() => setFocusedDate(null)}
+                            refreshKey={lastFlushId}
+                        />
+
+                        <WeeklyHeatmap refreshKey={lastFlushId} />
+                    </>
+                )}
 
                 <section className="chart-section">
                     <div className="section-header">
@@ -120,7 +172,7 @@ export default function App() {
                             <BarChart
                                 data={monthlyData}
                                 barClass="monthly-bar"
-                                onBarClick={(index, item) => setFocusedDate(item.date)}
+                                onBarClick={hideHours ? undefined : (index, item) => setFocusedDate(item.date)}
                             />
                         )}
                     </div>
@@ -0,0 +1,48 @@
+// Helpers for placing annotations from /api/annotations on charts
+
+function dateKey(date) {
+    const year = date.getFullYear();
+    const month = String(date.getMonth() + 1).padStart(2, '0');
+    const day = String(date.getDate()).padStart(2, '0');
+    return `${year}-${month}-${day}`;
+}
+
+// the logical day a time falls in, given days start at newDayHour
+function logicalDay(time, newDayHour) {
+    const shifted = new Date(time);
+    shifted.setHours(shifted.getHours() - newDayHour);
+    return new Date(shifted.getFullYear(), shifted.getMonth(), shifted.getDate());
+}
+
+export function describeAnnotation(annotation) {
+    const tags = annotation.tags.length > 0 ? ` [${annotation.tags.join(', ')}]` : '';
+    return `${annotation.note || 'Annotation'}${tags}`;
+}
+
+// annotationsByDay maps YYYY-MM-DD dates to the annotations covering them
+export function annotationsByDay(annotations, newDayHour) {
+    const byDay = {};
+
+    (annotations || []).forEach(annotation => {
+        const first = logicalDay(new Date(annotation.start), newDayHour);
+        const last = logicalDay(new Date(new Date(annotation.end).getTime() - 1), newDayHour);
+
+        for (let day = first; day <= last; day.setDate(day.getDate() + 1)) {
+            const key = dateKey(day);
+            (byDay[key] = byDay[key] || []).push(annotation);
+        }
+    });
+
+    return byDay;
+}
+
+// annotationsForHour returns the annotations overlapping the hour starting at
+// hourStart
+export function annotationsForHour(annotations, hourStart) {
+    const start = hourStart.getTime();
+    const end = start + 60 * 60 * 1000;
+
+    return (annotations || []).filter(annotation =>
+        new Date(annotation.start).getTime() < end && new Date(annotation.end).getTime() > start
+    );
+}
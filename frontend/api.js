@@ -0,0 +1,23 @@
+// A dashboard exported with `selfwatch publish` reads pre-computed JSON files
+// instead of the API, see staticApiPath in selfwatch/publish.go
+export const isStatic = !!window.CONFIG?.static;
+
+// apiUrl maps an API path to its snapshot when static, eg.
+// /api/hourly?date=2024-12-10 to api/hourly/date-2024-12-10.json
+export function apiUrl(path) {
+    if (!isStatic) {
+        return path;
+    }
+
+    const [base, query] = path.split('?');
+    let name = base.replace(/^\//, '');
+    if (query) {
+        name += '/' + query.replace(/[=&]/g, '-');
+    }
+    return `${name}.json`;
+}
+
+// currentTime is when the snapshot was generated when static
+export function currentTime() {
+    return isStatic ? new Date(window.CONFIG.generatedAt) : new Date();
+}
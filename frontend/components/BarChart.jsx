@@ -28,6 +28,9 @@ export default memo(function BarChart({ data, barClass, onBarClick }) {
                         style={clickable ? { cursor: 'pointer' } : undefined}
                     >
                         <div className="bar-area">
+                            {item.marker && (
+                                <div className="bar-marker" title={item.marker} />
+                            )}
                             <div
                                 className={`bar ${barClass}`}
                                 style={{ height: `${barHeight}px` }}
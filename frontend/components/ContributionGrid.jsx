@@ -1,4 +1,5 @@
 import React, { memo } from 'react';
+import { annotationsByDay, describeAnnotation } from '../annotations';
 
 const MONTHS = ['Jan', 'Feb', 'Mar', 'Apr', 'May', 'Jun', 'Jul', 'Aug', 'Sep', 'Oct', 'Nov', 'Dec'];
 const WEEKDAYS = ['', 'Mon', '', 'Wed', '', 'Fri', ''];
@@ -11,12 +12,13 @@ function getColor(p) {
     return `color-mix(in oklch, #1f2630, #39d353 ${p * 100}%)`;
 }
 
-export default memo(function ContributionGrid({ data, year }) {
+export default memo(function ContributionGrid({ data, year, annotations, newDayHour }) {
 
     const countByDay = {};
     data.forEach(d => { countByDay[d.Day] = d.Count; });
 
     const maxCount = Math.max(...data.map(d => d.Count), 1);
+    const annotated = annotationsByDay(annotations, newDayHour || 0);
 
     const startOfYear = new Date(year, 0, 1);
     const startDayOfWeek = startOfYear.getDay();
@@ -25,8 +27,9 @@ export default memo(function ContributionGrid({ data, year }) {
     gridStart.setDate(gridStart.getDate() - startDayOfWeek);
 
     const endOfYear = new Date(year, 11, 31);
-    const totalDays = Math.ceil((endOfYear - gridStart) / (1000 * 60 * 60 * 24)) + 1;
-    const totalWeeks = Math.min(Math.ceil(totalDays / 7), 53);
+    const totalDays = Math.round((endOfYear - gridStart) / (1000 * 60 * 60 * 24)) + 1;
+    // usually 53 weeks, 54 when a leap year starts on Saturday
+    const totalWeeks = Math.ceil(totalDays / 7);
 
     const monthLabels = [];
     let currentMonth = -1;
@@ -55,12 +58,16 @@ export default memo(function ContributionGrid({ data, year }) {
                 const dateStr = currentDate.toISOString().split('T')[0];
                 const count = countByDay[dateStr] || 0;
                 const scaled = count / maxCount;
-                const title = `${currentDate.toLocaleDateString('en-US', { weekday: 'short', month: 'short', day: 'numeric' })}: ${count.toLocaleString()} keys`;
+                const dayAnnotations = annotated[dateStr] || [];
+                const title = [
+                    `${currentDate.toLocaleDateString('en-US', { weekday: 'short', month: 'short', day: 'numeric' })}: ${count.toLocaleString()} keys`,
+                    ...dayAnnotations.map(describeAnnotation)
+                ].join('\n');
 
                 cells.push(
                     <div
                         key={week}
-                        className="grid-cell day-cell"
+                        className={`grid-cell day-cell ${dayAnnotations.length > 0 ? 'annotated' : ''}`}
                         style={{ backgroundColor: getColor(scaled) }}
                         title={title}
                     />
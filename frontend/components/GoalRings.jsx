@@ -0,0 +1,59 @@
+import React, { memo, useState, useEffect } from 'react';
+import { apiUrl } from '../api';
+
+const RADIUS = 16;
+const CIRCUMFERENCE = 2 * Math.PI * RADIUS;
+
+function ringClass(goal) {
+    if (goal.kind === 'max') {
+        return goal.met ? 'goal-ring under' : 'goal-ring over';
+    }
+    return goal.met ? 'goal-ring met' : 'goal-ring';
+}
+
+function formatValue(goal) {
+    const unit = goal.metric === 'active_minutes' ? ' min' : '';
+    return `${goal.value.toLocaleString()}${unit} / ${goal.target.toLocaleString()}${unit}`;
+}
+
+export default memo(function GoalRings({ refreshKey }) {
+    const [goals, setGoals] = useState(null);
+
+    useEffect(() => {
+        fetch(apiUrl('/api/goals'))
+            .then(res => res.json())
+            .then(setGoals)
+            .catch(console.error);
+    }, [refreshKey]);
+
+    if (!goals || goals.length === 0) {
+        return null;
+    }
+
+    return (
+        <div className="goal-rings">
+            {goals.map(goal => {
+                const filled = Math.min(1, goal.progress) * CIRCUMFERENCE;
+                return (
+                    <div key={goal.name} className={ringClass(goal)}>
+                        <svg width="40" height="40" viewBox="0 0 40 40">
+                            <circle className="goal-ring-track" cx="20" cy="20" r={RADIUS} />
+                            <circle
+                                className="goal-ring-fill"
+                                cx="20"
+                                cy="20"
+                                r={RADIUS}
+                                strokeDasharray={`${filled} ${CIRCUMFERENCE}`}
+                                transform="rotate(-90 20 20)"
+                            />
+                        </svg>
+                        <div className="goal-label">{goal.name}</div>
+                        <div className="goal-tooltip">
+                            {goal.kind === 'max' ? 'Under ' : ''}{formatValue(goal)}
+                        </div>
+                    </div>
+                );
+            })}
+        </div>
+    );
+});
@@ -1,5 +1,7 @@
 import React, { useState, useEffect, memo } from 'react';
 import BarChart from './BarChart';
+import { apiUrl, currentTime, isStatic } from '../api';
+import { annotationsForHour, describeAnnotation } from '../annotations';
 
 function formatHourlyData(rawData, offset) {
     const countByHour = {};
@@ -7,7 +9,7 @@ function formatHourlyData(rawData, offset) {
         countByHour[d.Hour] = d.Count;
     });
 
-    const now = new Date();
+    const now = currentTime();
     now.setDate(now.getDate() - offset);
     const data = [];
 
@@ -23,7 +25,8 @@ function formatHourlyData(rawData, offset) {
 
         data.push({
             label: hour + ':00',
-            count: countByHour[hourKey] || 0
+            count: countByHour[hourKey] || 0,
+            start: hourDate
         });
     }
 
@@ -31,6 +34,7 @@ function formatHourlyData(rawData, offset) {
 }
 
 function formatHourlyDataForDate(rawData, dateStr) {
+    const [year, month, day] = dateStr.split('-').map(Number);
     const countByHour = {};
     rawData.forEach(d => {
         countByHour[d.Hour] = d.Count;
@@ -43,15 +47,55 @@ function formatHourlyDataForDate(rawData, dateStr) {
 
         data.push({
             label: hourStr + ':00',
-            count: countByHour[hourKey] || 0
+            count: countByHour[hourKey] || 0,
+            start: new Date(year, month - 1, day, hour)
         });
     }
 
     return data;
 }
 
+// annotationUrls returns where to find the annotations overlapping [from, to).
+// A static snapshot only has them by year, and a year starts at NewDayHour so
+// the early hours of January 1st are in the year before.
+function annotationUrls(from, to) {
+    if (!isStatic) {
+        return [`/api/annotations?from=${encodeURIComponent(from.toISOString())}&to=${encodeURIComponent(to.toISOString())}`];
+    }
+
+    const urls = [];
+    for (let year = from.getFullYear() - 1; year <= to.getFullYear(); year++) {
+        urls.push(`/api/annotations?from=${year}-01-01&to=${year}-12-31`);
+    }
+    return urls;
+}
+
+// addAnnotations marks the hours covered by annotations
+function addAnnotations(data) {
+    const from = data[0].start;
+    const to = new Date(data[data.length - 1].start.getTime() + 60 * 60 * 1000);
+
+    const requests = annotationUrls(from, to).map(url =>
+        fetch(apiUrl(url))
+            .then(res => res.ok ? res.json() : [])
+            .catch(() => [])
+    );
+
+    return Promise.all(requests)
+        .then(results => {
+            // an annotation spanning new year is in both years
+            const byId = new Map();
+            results.flat().forEach(annotation => byId.set(annotation.id, annotation));
+            return [...byId.values()];
+        })
+        .then(annotations => data.map(d => {
+            const found = annotationsForHour(annotations, d.start);
+            return found.length > 0 ? { ...d, marker: found.map(describeAnnotation).join('\n') } : d;
+        }));
+}
+
 function getDateRange(offset) {
-    const now = new Date();
+    const now = currentTime();
     const end = new Date(now);
     end.setDate(end.getDate() - offset);
 
@@ -72,7 +116,7 @@ function formatFocusedDate(dateStr) {
     return date.toLocaleDateString('en-US', { weekday: 'short', month: 'short', day: 'numeric', year: 'numeric' });
 }
 
-export default memo(function HourlyActivity({ focusedDate, onClearFocus }) {
+export default memo(function HourlyActivity({ focusedDate, onClearFocus, refreshKey }) {
     const [offset, setOffset] = useState(0);
     const [data, setData] = useState(null);
     const [loading, setLoading] = useState(true);
@@ -86,15 +130,15 @@ export default memo(function HourlyActivity({ focusedDate, onClearFocus }) {
             ? `/api/hourly?date=${focusedDate}`
             : `/api/hourly?offset=${offset}`;
 
-        fetch(url)
+        fetch(apiUrl(url))
             .then(res => {
                 if (!res.ok) throw new Error('Failed to fetch hourly data');
                 return res.json();
             })
-            .then(raw => {
-                const formatted = focusedDate
-                    ? formatHourlyDataForDate(raw, focusedDate)
-                    : formatHourlyData(raw, offset);
+            .then(raw => addAnnotations(focusedDate
+                ? formatHourlyDataForDate(raw, focusedDate)
+                : formatHourlyData(raw, offset)))
+            .then(formatted => {
                 setData(formatted);
                 setLoading(false);
             })
@@ -102,7 +146,7 @@ export default memo(function HourlyActivity({ focusedDate, onClearFocus }) {
                 setError(err.message);
                 setLoading(false);
             });
-    }, [offset, focusedDate]);
+    }, [offset, focusedDate, refreshKey]);
 
     const title = focusedDate
         ? formatFocusedDate(focusedDate)
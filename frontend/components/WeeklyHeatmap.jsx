@@ -1,4 +1,5 @@
 import React, { memo, useState, useEffect } from 'react';
+import { apiUrl } from '../api';
 
 const WEEKDAYS = ['Sun', 'Mon', 'Tue', 'Wed', 'Thu', 'Fri', 'Sat'];
 const HOUR_LABELS = [0, 6, 12, 18];
@@ -11,15 +12,15 @@ function getColor(p) {
     return `color-mix(in oklch, #1f2630, #39d353 ${p * 100}%)`;
 }
 
-export default memo(function WeeklyHeatmap() {
+export default memo(function WeeklyHeatmap({ refreshKey }) {
     const [data, setData] = useState(null);
 
     useEffect(() => {
-        fetch('/api/weekly-heatmap')
+        fetch(apiUrl('/api/weekly-heatmap'))
             .then(res => res.json())
             .then(setData)
             .catch(console.error);
-    }, []);
+    }, [refreshKey]);
 
     if (!data) {
         return (
@@ -1,20 +1,22 @@
 import React, { useState, useEffect } from 'react';
 import ContributionGrid from './ContributionGrid';
+import { apiUrl, currentTime } from '../api';
 
-const currentYear = new Date().getFullYear();
+const currentYear = currentTime().getFullYear();
 
 export default function YearlyActivity() {
     const [year, setYear] = useState(currentYear);
     const [data, setData] = useState(null);
     const [loading, setLoading] = useState(true);
     const [error, setError] = useState(null);
+    const [annotations, setAnnotations] = useState([]);
     const newDayHour = window.CONFIG?.newDayHour || 0;
 
     useEffect(() => {
         setLoading(true);
         setError(null);
 
-        fetch(`/api/yearly?year=${year}`)
+        fetch(apiUrl(`/api/yearly?year=${year}`))
             .then(res => {
                 if (!res.ok) throw new Error('Failed to fetch yearly data');
                 return res.json();
@@ -29,6 +31,13 @@ export default function YearlyActivity() {
             });
     }, [year]);
 
+    useEffect(() => {
+        fetch(apiUrl(`/api/annotations?from=${year}-01-01&to=${year}-12-31`))
+            .then(res => res.ok ? res.json() : [])
+            .then(setAnnotations)
+            .catch(() => setAnnotations([]));
+    }, [year]);
+
     return (
         <section className="contribution-section">
             <div className="section-header">
@@ -42,7 +51,7 @@ export default function YearlyActivity() {
                 </div>
             </div>
             <div className={loading ? 'loading' : ''}>
-                {data && <ContributionGrid data={data} year={year} />}
+                {data && <ContributionGrid data={data} year={year} annotations={annotations} newDayHour={newDayHour} />}
             </div>
             {error && <div style={{ color: 'red' }}>Error: {error}</div>}
         </section>
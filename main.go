@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/leafo/selfwatch/selfwatch"
@@ -36,12 +39,22 @@ func main() {
 	log.Printf("Starting selfwatch (commit: %s, built: %s)", commitHash, buildDate)
 
 	config := selfwatch.LoadConfig(configFname)
+	loc := config.Location()
 
 	command := flag.Arg(0)
 	if command == "" {
 		command = "start"
 	}
 
+	if command == "keygen" {
+		key, err := selfwatch.GenerateEncryptionKey()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Println(key)
+		return
+	}
+
 	// For status command, fail if database doesn't exist
 	if command == "status" && !config.DbExists() {
 		fmt.Fprintf(os.Stderr, "Database not found: %s\n", config.DbName)
@@ -61,9 +74,13 @@ func main() {
 		storage.CreateSchema()
 	}
 
+	if err := storage.UpdateSchema(); err != nil {
+		log.Fatal(err.Error())
+	}
+
 	switch command {
 	case "summary":
-		out, err := storage.DailyCounts(7, config.NewDayHour)
+		out, err := storage.DailyCounts(7, config.NewDayHour, storage.Now().In(loc))
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -73,46 +90,276 @@ func main() {
 		}
 
 	case "status":
-		out, err := storage.DailyCounts(7, config.NewDayHour)
+		statusFlags := flag.NewFlagSet("status", flag.ExitOnError)
+		syncStatus := statusFlags.Bool("sync", false, "Print remote sync status")
+		goalsStatus := statusFlags.Bool("goals", false, "Print progress towards goals")
+		breaksStatus := statusFlags.Bool("breaks", false, "Print breaks taken today")
+		statusFormat := statusFlags.String("format", "text", "Output format: text, json, i3bar, i3blocks, waybar, polybar or a Go template")
+		watch := statusFlags.Bool("watch", false, "Keep printing the status every interval")
+		interval := statusFlags.Duration("interval", 5*time.Second, "How often to print the status with --watch")
+		statusFlags.Parse(flag.Args()[1:])
+
+		if *breaksStatus {
+			printBreaks(storage, config.NewDayHour, storage.Now().In(loc))
+			return
+		}
+
+		if *syncStatus {
+			printSyncStatus(storage)
+			return
+		}
+
+		if *goalsStatus {
+			printGoals(storage, config.Goals, config.NewDayHour, storage.Now().In(loc))
+			return
+		}
+
+		formatter, err := selfwatch.NewStatusFormatter(*statusFormat)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
 
-		dateKey := func(t time.Time) string {
-			return fmt.Sprintf("%v-%v-%v",
-				t.Year(),
-				fmt.Sprintf("%02d", t.Month()),
-				fmt.Sprintf("%02d", t.Day()))
+		if *watch {
+			if err := formatter.Begin(os.Stdout); err != nil {
+				log.Fatal(err.Error())
+			}
 		}
 
-		byDay := map[string]int64{}
-		for _, row := range out {
-			byDay[row.Day] = row.Count
+		for {
+			status, err := storage.Status(config.NewDayHour, storage.Now().In(loc))
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+
+			if err := formatter.Write(os.Stdout, status, *watch); err != nil {
+				log.Fatal(err.Error())
+			}
+
+			if !*watch {
+				break
+			}
+
+			time.Sleep(*interval)
+		}
+
+	case "stats":
+		stats, err := storage.Stats(config.StreakThreshold, config.NewDayHour, storage.Now().In(loc))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		printStats(stats)
+
+	case "annotate":
+		annotateFlags := flag.NewFlagSet("annotate", flag.ExitOnError)
+		tags := annotateFlags.String("tags", "", "Comma separated tags, eg. vacation,travel")
+		to := annotateFlags.String("to", "", "Last date, or end time, of the annotation")
+		from := annotateFlags.String("from", "", "List annotations from this date")
+		list := annotateFlags.Bool("list", false, "List annotations")
+		deleteId := annotateFlags.Int64("delete", 0, "Delete the annotation with this id")
+		annotateFlags.Parse(flag.Args()[1:])
+
+		switch {
+		case *deleteId != 0:
+			deleted, err := storage.DeleteAnnotation(*deleteId)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			if !deleted {
+				fmt.Fprintf(os.Stderr, "Annotation not found: %d\n", *deleteId)
+				os.Exit(1)
+			}
+
+		case *list:
+			now := storage.Now().In(loc)
+			listFrom, listTo := now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0)
+			if *from != "" {
+				listFrom = parseTimeArg(*from, loc, config.NewDayHour)
+			}
+			if *to != "" {
+				listTo = parseTimeArg(*to, loc, config.NewDayHour).AddDate(0, 0, 1)
+			}
+			printAnnotations(storage, listFrom, listTo)
+
+		default:
+			if annotateFlags.NArg() < 1 {
+				fmt.Fprintln(os.Stderr, "Usage: selfwatch annotate [--tags a,b] [--to END] <date|time> [note]")
+				os.Exit(1)
+			}
+
+			start := annotateFlags.Arg(0)
+			note := strings.Join(annotateFlags.Args()[1:], " ")
+
+			var annotation *selfwatch.Annotation
+			if _, err := time.Parse("2006-01-02", start); err == nil {
+				last := start
+				if *to != "" {
+					last = *to
+				}
+				annotation, err = selfwatch.NewDayAnnotation(start, last, loc, config.NewDayHour)
+				if err != nil {
+					log.Fatal(err.Error())
+				}
+			} else {
+				if *to == "" {
+					log.Fatal("--to is required when annotating a time range")
+				}
+				annotation = &selfwatch.Annotation{
+					Start: parseTimeArg(start, loc, config.NewDayHour),
+					End:   parseTimeArg(*to, loc, config.NewDayHour),
+				}
+			}
+
+			annotation.Note = note
+			annotation.Tags = selfwatch.ParseTags(*tags)
+
+			if err := storage.AddAnnotation(annotation); err != nil {
+				log.Fatal(err.Error())
+			}
+			fmt.Println("Added annotation", annotation.Id)
+		}
+
+	case "report":
+		reportFlags := flag.NewFlagSet("report", flag.ExitOnError)
+		period := reportFlags.String("period", "week", "Period to report on: week or month")
+		format := reportFlags.String("format", "text", "Output format: text, markdown or html")
+		offset := reportFlags.Int("offset", 1, "How many periods back to report on, 0 for the current one")
+		reportFlags.Parse(flag.Args()[1:])
+
+		from, to, err := selfwatch.ReportRange(*period, storage.Now().In(loc), config.NewDayHour, *offset)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		report, err := storage.Report(*period, from, to, config.NewDayHour, config.SessionIdle(), config.StreakThreshold)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		if err := report.Write(os.Stdout, *format); err != nil {
+			log.Fatal(err.Error())
 		}
 
-		today := time.Now().Add(time.Hour * time.Duration(-config.NewDayHour))
-		yesterday := today.Add(time.Hour * -24)
+	case "timesheet":
+		timesheetFlags := flag.NewFlagSet("timesheet", flag.ExitOnError)
+		period := timesheetFlags.String("period", "month", "Period to export: week or month")
+		offset := timesheetFlags.Int("offset", 0, "How many periods back to export, 0 for the current one")
+		from := timesheetFlags.String("from", "", "Export from this date or time instead of a period")
+		to := timesheetFlags.String("to", "", "Export through this date, or until this time, instead of a period")
+		round := timesheetFlags.Int64("round", 15, "Round each day's time on a project up to a multiple of this many minutes")
+		project := timesheetFlags.String("project", "", "Only export this project")
+		format := timesheetFlags.String("format", "text", "Output format: text, csv or ical")
+		timesheetFlags.Parse(flag.Args()[1:])
 
-		todaysCount := byDay[dateKey(today)]
-		yesterdaysCount := byDay[dateKey(yesterday)]
+		sheetFrom, sheetTo, err := selfwatch.ReportRange(*period, storage.Now().In(loc), config.NewDayHour, *offset)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		if *from != "" {
+			sheetFrom = parseTimeArg(*from, loc, config.NewDayHour)
+		}
+		if *to != "" {
+			sheetTo = parseTimeArg(*to, loc, config.NewDayHour)
+			// a date includes the whole day
+			if len(*to) == len("2006-01-02") {
+				sheetTo = sheetTo.AddDate(0, 0, 1)
+			}
+		}
 
-		delta := todaysCount - yesterdaysCount
+		timesheet, err := storage.Timesheet(sheetFrom, sheetTo, config.NewDayHour, config.SessionIdle(), *round, *project)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
 
-		p := ""
-		if delta >= 0 {
-			p = "+"
+		if err := timesheet.Write(os.Stdout, *format); err != nil {
+			log.Fatal(err.Error())
 		}
 
-		fmt.Print(todaysCount, " (", p, delta, ")\n")
+	case "projects":
+		projectsFlags := flag.NewFlagSet("projects", flag.ExitOnError)
+		from := projectsFlags.String("from", "", "Count keys from this date or time (default: 30 days ago)")
+		to := projectsFlags.String("to", "", "Count keys through this date, or until this time (default: now)")
+		projectsFlags.Parse(flag.Args()[1:])
+
+		countsTo := storage.Now().In(loc)
+		if *to != "" {
+			countsTo = parseTimeArg(*to, loc, config.NewDayHour)
+			// a date includes the whole day
+			if len(*to) == len("2006-01-02") {
+				countsTo = countsTo.AddDate(0, 0, 1)
+			}
+		}
+
+		countsFrom := countsTo.AddDate(0, 0, -30)
+		if *from != "" {
+			countsFrom = parseTimeArg(*from, loc, config.NewDayHour)
+		}
+
+		printProjects(storage, countsFrom, countsTo)
+
+	case "reclassify":
+		rules, err := selfwatch.NewProjectRules(config.Projects)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		changed, err := storage.Reclassify(rules)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("Reclassified %d rows\n", changed)
 
 	case "start":
+		rules, err := selfwatch.NewProjectRules(config.Projects)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		storage.SetProjectRules(rules)
+
 		recorder := selfwatch.NewRecorder()
 		storage.BindRecorder(recorder, config.SyncDelay)
 
+		// store the keys waiting to be written before exiting
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+
+			if err := storage.Close(); err != nil {
+				log.Print(err.Error())
+			}
+			os.Exit(0)
+		}()
+
+		for _, exporter := range selfwatch.NewMetricsExporters(config) {
+			selfwatch.BindExporter(storage, exporter)
+		}
+
+		if breaks := selfwatch.NewBreakMonitor(config, storage); breaks != nil {
+			breaks.Bind(recorder)
+		}
+
+		if len(config.Goals) > 0 {
+			storage.RecordGoals(config.Goals, config.NewDayHour, config.Location(), time.Minute)
+		}
+
+		if webhooks := selfwatch.NewWebhooks(config, storage); webhooks != nil {
+			webhooks.Bind(recorder)
+		}
+
+		if config.MetricsAddr != "" {
+			metrics := selfwatch.NewRecorderMetrics(config.SessionIdle())
+			metrics.Bind(recorder, storage)
+
+			go func() {
+				log.Fatal(metrics.ListenAndServe(config.MetricsAddr))
+			}()
+		}
+
 		if config.RemoteUrl != "" {
-			remote := selfwatch.RemoteSync{
-				Url:     config.RemoteUrl,
-				Storage: storage,
+			remote, err := selfwatch.NewRemoteSync(config, storage)
+			if err != nil {
+				log.Fatal(err.Error())
 			}
 
 			if config.RemoteFlushDelay > 0 {
@@ -129,10 +376,254 @@ func main() {
 			addr = flag.Arg(1)
 		}
 		server := selfwatch.NewWebServer(storage, config, addr, commitHash, buildDate)
-		log.Fatal(server.Start())
+
+		// remove the unix socket before exiting
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+
+			if err := server.Close(); err != nil {
+				log.Print(err.Error())
+			}
+		}()
+
+		if err := server.Start(); err != nil {
+			log.Fatal(err.Error())
+		}
+
+	case "publish":
+		publishFlags := flag.NewFlagSet("publish", flag.ExitOnError)
+		round := publishFlags.Int64("round", 0, "Round every count to the nearest multiple of this")
+		hideHours := publishFlags.Bool("hide-hours", false, "Leave out activity by hour")
+		publishFlags.Parse(flag.Args()[1:])
+
+		if publishFlags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: selfwatch publish [--round N] [--hide-hours] <dir>")
+			os.Exit(1)
+		}
+
+		dir := publishFlags.Arg(0)
+		server := selfwatch.NewWebServer(storage, config, "", commitHash, buildDate)
+		err := server.Publish(dir, selfwatch.PublishOptions{
+			Round:     *round,
+			HideHours: *hideHours,
+		}, storage.Now().In(loc))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		log.Printf("Published dashboard to %s", dir)
+
+	case "receive":
+		addr := "localhost:8081"
+		if flag.NArg() > 1 {
+			addr = flag.Arg(1)
+		}
+		receiver, err := selfwatch.NewSyncReceiver(storage, config)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Fatal(receiver.ListenAndServe(addr))
+
+	case "import":
+		if config.RemoteUrl == "" {
+			log.Fatal("import requires RemoteUrl to be set")
+		}
+
+		remote, err := selfwatch.NewRemoteSync(config, storage)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		imported, err := remote.Import()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		fmt.Println("Imported", imported, "rows")
 
 	default:
 		log.Fatal("Unknown command:", command)
 	}
 
 }
+
+func printSyncStatus(storage *selfwatch.WatchStorage) {
+	status, err := storage.SyncStatus()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if status == nil {
+		fmt.Println("Sync has not run")
+		return
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+
+	fmt.Println("Remote:      ", status.RemoteUrl)
+	fmt.Println("Last attempt:", formatTime(status.LastAttempt))
+	fmt.Println("Last success:", formatTime(status.LastSuccess))
+	fmt.Println("Acked row:   ", status.AckedRowId)
+	fmt.Println("Pending:     ", status.PendingRows, "rows in", status.PendingChunks, "chunks")
+	fmt.Println("Lag:         ", time.Duration(status.LagSeconds)*time.Second)
+
+	if status.LastError != "" {
+		fmt.Println("Last error:  ", status.LastError)
+	}
+}
+
+func printStats(stats *selfwatch.Stats) {
+	formatStreak := func(streak selfwatch.Streak) string {
+		if streak.Days == 0 {
+			return "0 days"
+		}
+		return fmt.Sprintf("%d days (%s to %s)", streak.Days, streak.Start, streak.End)
+	}
+
+	formatBest := func(best *selfwatch.BestPeriod) string {
+		if best == nil {
+			return "none"
+		}
+		return fmt.Sprintf("%s\t%d", best.Period, best.Count)
+	}
+
+	fmt.Printf("Streaks of at least %d keys\n", stats.Threshold)
+	fmt.Println("  current:\t", formatStreak(stats.CurrentStreak))
+	fmt.Println("  longest:\t", formatStreak(stats.LongestStreak))
+
+	fmt.Println("Best")
+	fmt.Println("  day:\t", formatBest(stats.BestDay))
+	fmt.Println("  hour:\t", formatBest(stats.BestHour))
+	fmt.Println("  week:\t", formatBest(stats.BestWeek))
+
+	fmt.Println("Average by weekday")
+	for _, average := range stats.WeekdayAverages {
+		fmt.Printf("  %s\t%.0f\n", average.Weekday, average.Average)
+	}
+
+	fmt.Println("Totals by year")
+	for _, total := range stats.YearTotals {
+		fmt.Printf("  %s\t%d\n", total.Year, total.Count)
+	}
+}
+
+func printGoals(storage *selfwatch.WatchStorage, goalConfigs []selfwatch.GoalConfig, newDayHour int, now time.Time) {
+	goals, err := storage.EvaluateGoals(goalConfigs, newDayHour, now)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(goals) == 0 {
+		fmt.Println("No goals for today")
+		return
+	}
+
+	for _, goal := range goals {
+		state := "not met"
+		if goal.Met {
+			state = "met"
+		}
+
+		comparison := "at least"
+		if goal.Kind == selfwatch.GoalKindMax {
+			comparison = "under"
+		}
+
+		fmt.Printf("%s\t%d/%d %s (%s %d, %.0f%%) %s\n", goal.Name, goal.Value, goal.Target,
+			strings.ReplaceAll(goal.Metric, "_", " "), comparison, goal.Target, goal.Progress*100, state)
+	}
+}
+
+func printBreaks(storage *selfwatch.WatchStorage, newDayHour int, now time.Time) {
+	counts, err := storage.BreakCounts(selfwatch.LogicalDayStart(now, newDayHour), now)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(counts) == 0 {
+		fmt.Println("No breaks today")
+		return
+	}
+
+	for _, count := range counts {
+		fmt.Printf("%s\t%d (%.0f minutes)\n", count.Kind, count.Count, count.Minutes)
+	}
+}
+
+// parseTimeArg parses a YYYY-MM-DD date, a "YYYY-MM-DD HH:MM" time in loc
+// or an RFC 3339 time. Dates refer to when that day starts.
+func parseTimeArg(value string, loc *time.Location, newDayHour int) time.Time {
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return selfwatch.DayStart(t, newDayHour)
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02 15:04", value, loc); err == nil {
+		return t
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("Invalid time %q, expected YYYY-MM-DD, \"YYYY-MM-DD HH:MM\" or RFC 3339", value)
+	}
+	return t
+}
+
+func printAnnotations(storage *selfwatch.WatchStorage, from, to time.Time) {
+	annotations, err := storage.Annotations(from, to, from.Location())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(annotations) == 0 {
+		fmt.Println("No annotations")
+		return
+	}
+
+	for _, annotation := range annotations {
+		var when string
+		if annotation.AllDay {
+			first := annotation.Start.Format("2006-01-02")
+			last := annotation.End.AddDate(0, 0, -1).Format("2006-01-02")
+			when = first
+			if last != first {
+				when = first + " to " + last
+			}
+		} else {
+			when = annotation.Start.Format("2006-01-02 15:04") + " to " + annotation.End.Format("2006-01-02 15:04")
+		}
+
+		tags := ""
+		if len(annotation.Tags) > 0 {
+			tags = " [" + strings.Join(annotation.Tags, ", ") + "]"
+		}
+
+		fmt.Printf("%d\t%s%s\t%s\n", annotation.Id, when, tags, annotation.Note)
+	}
+}
+
+func printProjects(storage *selfwatch.WatchStorage, from, to time.Time) {
+	counts, err := storage.ProjectCounts(from, to)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(counts) == 0 {
+		fmt.Println("No keys recorded")
+		return
+	}
+
+	for _, count := range counts {
+		project := count.Project
+		if project == "" {
+			project = "(unclassified)"
+		}
+		fmt.Printf("%s\t%d keys\t%dh %02dm\n", project, count.Count, count.Minutes/60, count.Minutes%60)
+	}
+}
@@ -0,0 +1,287 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notes and tags attached to a range of time, eg. a vacation or an on-call
+// shift
+var annotationsSchema = `
+CREATE TABLE IF NOT EXISTS annotations (
+	id INTEGER NOT NULL,
+	start_at DATETIME NOT NULL,
+	end_at DATETIME NOT NULL,
+	all_day INTEGER NOT NULL DEFAULT 0,
+	note TEXT NOT NULL DEFAULT '',
+	tags TEXT NOT NULL DEFAULT '',
+	created_at DATETIME,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS ix_annotations_start_at ON annotations (start_at);
+`
+
+type Annotation struct {
+	Id    int64     `json:"id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// AllDay is set for annotations of whole days, which start and end at
+	// the new day hour
+	AllDay bool     `json:"allDay"`
+	Note   string   `json:"note"`
+	Tags   []string `json:"tags"`
+}
+
+// NewDayAnnotation covers the days from first to last, inclusive, given as
+// YYYY-MM-DD dates in loc
+func NewDayAnnotation(first, last string, loc *time.Location, newDayHour int) (*Annotation, error) {
+	start, err := time.ParseInLocation("2006-01-02", first, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := time.ParseInLocation("2006-01-02", last, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	if end.Before(start) {
+		return nil, fmt.Errorf("annotation ends before it starts")
+	}
+
+	return &Annotation{
+		Start:  DayStart(start, newDayHour),
+		End:    DayStart(end.AddDate(0, 0, 1), newDayHour),
+		AllDay: true,
+		Tags:   make([]string, 0),
+	}, nil
+}
+
+// ParseTags splits a comma separated list of tags
+func ParseTags(tags string) []string {
+	out := make([]string, 0)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+func (s *WatchStorage) AddAnnotation(annotation *Annotation) error {
+	const sqlTime = "2006-01-02 15:04:05"
+
+	if !annotation.Start.Before(annotation.End) {
+		return fmt.Errorf("annotation ends before it starts")
+	}
+
+	if annotation.Tags == nil {
+		annotation.Tags = make([]string, 0)
+	}
+
+	res, err := s.db.Exec(`insert into annotations(start_at, end_at, all_day, note, tags, created_at)
+		values(?, ?, ?, ?, ?, ?)`,
+		annotation.Start.UTC().Format(sqlTime), annotation.End.UTC().Format(sqlTime), annotation.AllDay,
+		annotation.Note, strings.Join(annotation.Tags, ","), s.Now().UTC().Format(sqlTime))
+
+	if err != nil {
+		return err
+	}
+
+	annotation.Id, err = res.LastInsertId()
+	return err
+}
+
+// Annotations returns the annotations overlapping [from, to), in loc
+func (s *WatchStorage) Annotations(from, to time.Time, loc *time.Location) ([]Annotation, error) {
+	const sqlTime = "2006-01-02 15:04:05"
+
+	rows, err := s.db.Query(`
+		select id, start_at, end_at, all_day, note, tags
+		from annotations
+		where start_at < ? and end_at > ?
+		order by start_at, id;
+	`, to.UTC().Format(sqlTime), from.UTC().Format(sqlTime))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	out := make([]Annotation, 0)
+	for rows.Next() {
+		var annotation Annotation
+		var tags string
+
+		err := rows.Scan(&annotation.Id, &annotation.Start, &annotation.End, &annotation.AllDay, &annotation.Note, &tags)
+		if err != nil {
+			return nil, err
+		}
+
+		annotation.Start = annotation.Start.In(loc)
+		annotation.End = annotation.End.In(loc)
+		annotation.Tags = ParseTags(tags)
+		out = append(out, annotation)
+	}
+
+	return out, rows.Err()
+}
+
+// DeleteAnnotation removes an annotation, returning false if it didn't exist
+func (s *WatchStorage) DeleteAnnotation(id int64) (bool, error) {
+	res, err := s.db.Exec(`delete from annotations where id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := res.RowsAffected()
+	return deleted > 0, err
+}
+
+// annotationRequest is the body of POST /api/annotations. Either the date,
+// optionally through to, or the start and end times are set.
+type annotationRequest struct {
+	Date  string    `json:"date"`
+	To    string    `json:"to"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Note  string    `json:"note"`
+	Tags  []string  `json:"tags"`
+}
+
+// handleAnnotations lists annotations with GET, filtered by the from and to
+// parameters, and creates them with POST
+func (ws *WebServer) handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+
+		loc, err := ws.location(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := ws.Storage.Now()
+
+		from := now.AddDate(-1, 0, 0)
+		if fromParam := query.Get("from"); fromParam != "" {
+			parsed, _, err := parseRangeTime(fromParam, loc, ws.Config.NewDayHour)
+			if err != nil {
+				http.Error(w, "Invalid from, expected YYYY-MM-DD or RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			from = parsed
+		}
+
+		to := now.AddDate(0, 0, 1)
+		if toParam := query.Get("to"); toParam != "" {
+			parsed, isDate, err := parseRangeTime(toParam, loc, ws.Config.NewDayHour)
+			if err != nil {
+				http.Error(w, "Invalid to, expected YYYY-MM-DD or RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			if isDate {
+				parsed = parsed.AddDate(0, 0, 1)
+			}
+			to = parsed
+		}
+
+		annotations, err := ws.Storage.Annotations(from, to, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(annotations)
+
+	case "POST":
+		// a form on another site can post to the dashboard, but can't send
+		// JSON without a preflight
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "Expected Content-Type application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req annotationRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "Invalid annotation", http.StatusBadRequest)
+			return
+		}
+
+		annotation := &Annotation{Start: req.Start, End: req.End}
+		if req.Date != "" {
+			last := req.To
+			if last == "" {
+				last = req.Date
+			}
+
+			loc, err := ws.location(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			annotation, err = NewDayAnnotation(req.Date, last, loc, ws.Config.NewDayHour)
+			if err != nil {
+				http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+
+		annotation.Note = req.Note
+		annotation.Tags = ParseTags(strings.Join(req.Tags, ","))
+
+		if annotation.Start.IsZero() || !annotation.Start.Before(annotation.End) {
+			http.Error(w, "Annotations need a date, or a start before their end", http.StatusBadRequest)
+			return
+		}
+
+		if err := ws.Storage.AddAnnotation(annotation); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(annotation)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAnnotation deletes the annotation with DELETE /api/annotations/<id>
+func (ws *WebServer) handleAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/annotations/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	deleted, err := ws.Storage.DeleteAnnotation(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !deleted {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotations(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	vacation, err := NewDayAnnotation("2024-12-20", "2024-12-31", time.UTC, 4)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vacation.Note = "Winter break"
+	vacation.Tags = ParseTags("vacation, travel,")
+
+	if err := storage.AddAnnotation(vacation); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	oncall := &Annotation{
+		Start: time.Date(2025, 1, 2, 22, 0, 0, 0, time.UTC),
+		End:   time.Date(2025, 1, 3, 2, 0, 0, 0, time.UTC),
+		Tags:  []string{"on-call"},
+	}
+	if err := storage.AddAnnotation(oncall); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := NewDayAnnotation("2024-12-31", "2024-12-20", time.UTC, 4); err == nil {
+		t.Fatal("Expected an error for an annotation ending before it starts")
+	}
+
+	// the last day of the vacation ends at 4am the next day
+	annotations, err := storage.Annotations(time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC), time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC), time.UTC)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(annotations) != 2 {
+		t.Fatalf("Expected 2 annotations, got %+v", annotations)
+	}
+
+	first := annotations[0]
+	if first.Id != vacation.Id || !first.AllDay || first.Note != "Winter break" || strings.Join(first.Tags, ",") != "vacation,travel" {
+		t.Fatalf("Unexpected annotation %+v", first)
+	}
+
+	if !first.End.Equal(time.Date(2025, 1, 1, 4, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected end %v", first.End)
+	}
+
+	deleted, err := storage.DeleteAnnotation(vacation.Id)
+	if err != nil || !deleted {
+		t.Fatalf("Expected the annotation to be deleted: %v", err)
+	}
+
+	deleted, _ = storage.DeleteAnnotation(vacation.Id)
+	if deleted {
+		t.Fatal("Expected deleting a missing annotation to return false")
+	}
+}
+
+func TestWebAnnotations(t *testing.T) {
+	server := newTestWebServer(t, defaultConfig)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/api/annotations", "application/json",
+		strings.NewReader(`{"date": "2024-03-01", "to": "2024-03-03", "note": "crunch", "tags": ["work"]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var created Annotation
+	json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated || created.Id == 0 || !created.AllDay {
+		t.Fatalf("Unexpected response %d %+v", res.StatusCode, created)
+	}
+
+	res, err = http.Post(server.URL+"/api/annotations", "application/json",
+		strings.NewReader(`{"start": "2024-03-02T12:00:00Z", "end": "2024-03-02T10:00:00Z"}`))
+	expectStatus(t, res, err, http.StatusBadRequest)
+
+	// forms posted from other sites are rejected
+	for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		req, _ := http.NewRequest("POST", server.URL+"/api/annotations",
+			strings.NewReader(`{"date": "2024-03-02", "note": "forged"}`))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		res, err = http.DefaultClient.Do(req)
+		expectStatus(t, res, err, http.StatusUnsupportedMediaType)
+	}
+
+	res, err = http.Post(server.URL+"/api/annotations", "application/json; charset=utf-8",
+		strings.NewReader(`{"date": "2024-03-05", "note": "charset"}`))
+	expectStatus(t, res, err, http.StatusCreated)
+
+	res, err = http.Get(server.URL + "/api/annotations?from=2024-03-02&to=2024-03-02")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var annotations []Annotation
+	json.NewDecoder(res.Body).Decode(&annotations)
+	res.Body.Close()
+
+	if len(annotations) != 1 || annotations[0].Note != "crunch" || annotations[0].Tags[0] != "work" {
+		t.Fatalf("Unexpected annotations %+v", annotations)
+	}
+
+	deleteAnnotation := func(path string) (*http.Response, error) {
+		req, _ := http.NewRequest("DELETE", server.URL+path, nil)
+		return http.DefaultClient.Do(req)
+	}
+
+	res, err = deleteAnnotation("/api/annotations/" + strconv.FormatInt(created.Id, 10))
+	expectStatus(t, res, err, http.StatusNoContent)
+
+	res, err = deleteAnnotation("/api/annotations/" + strconv.FormatInt(created.Id, 10))
+	expectStatus(t, res, err, http.StatusNotFound)
+
+	res, err = http.Get(server.URL + "/api/annotations/1")
+	expectStatus(t, res, err, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,183 @@
+package selfwatch
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "selfwatch_session"
+	sessionLifetime   = 30 * 24 * time.Hour
+)
+
+// webSessions holds the sessions created by logging in with the web token.
+// They only live in memory, so restarting the server logs everyone out.
+type webSessions struct {
+	mu       sync.Mutex
+	sessions map[string]time.Time
+}
+
+func newWebSessions() *webSessions {
+	return &webSessions{sessions: make(map[string]time.Time)}
+}
+
+func (s *webSessions) create() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for existing, expires := range s.sessions {
+		if now.After(expires) {
+			delete(s.sessions, existing)
+		}
+	}
+
+	s.sessions[id] = now.Add(sessionLifetime)
+	return id, nil
+}
+
+func (s *webSessions) valid(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, found := s.sessions[id]
+	return found && time.Now().Before(expires)
+}
+
+func (s *webSessions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (ws *WebServer) authEnabled() bool {
+	return ws.Config.WebPassword != "" || ws.Config.WebToken != ""
+}
+
+// authenticated checks, in order, HTTP basic auth, a bearer token, and the
+// session cookie set by logging in
+func (ws *WebServer) authenticated(r *http.Request) bool {
+	cfg := ws.Config
+
+	if cfg.WebPassword != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			return secureCompare(user, cfg.WebUsername) && secureCompare(password, cfg.WebPassword)
+		}
+	}
+
+	if cfg.WebToken != "" {
+		if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			return secureCompare(token, cfg.WebToken)
+		}
+
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			return ws.sessions.valid(cookie.Value)
+		}
+	}
+
+	return false
+}
+
+func (ws *WebServer) requireAuth(next http.Handler) http.Handler {
+	if !ws.authEnabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (ws.Config.WebToken != "" && r.URL.Path == "/login") || ws.authenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// browsers visiting the dashboard are sent to the login form
+		if ws.Config.WebToken != "" && r.URL.Path == "/" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		if ws.Config.WebPassword != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="selfwatch"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// handleLogin registers the routes for logging in with the web token
+func (ws *WebServer) handleLogin(mux *http.ServeMux) error {
+	loginContent, err := webAssets.ReadFile("web/login.html")
+	if err != nil {
+		return err
+	}
+	loginTmpl, err := template.New("login").Parse(string(loginContent))
+	if err != nil {
+		return err
+	}
+
+	renderLogin := func(w http.ResponseWriter, status int, message string) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		loginTmpl.Execute(w, struct{ Error string }{message})
+	}
+
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			renderLogin(w, http.StatusOK, "")
+			return
+		}
+
+		if !secureCompare(r.PostFormValue("token"), ws.Config.WebToken) {
+			renderLogin(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+
+		id, err := ws.sessions.create()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    id,
+			Path:     "/",
+			MaxAge:   int(sessionLifetime.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			ws.sessions.remove(cookie.Value)
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:   sessionCookieName,
+			Path:   "/",
+			MaxAge: -1,
+		})
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+
+	return nil
+}
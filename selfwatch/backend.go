@@ -0,0 +1,96 @@
+package selfwatch
+
+import (
+	"time"
+)
+
+// Storage is where key counts are written and queried from. WatchStorage
+// stores them in SQLite, MemoryStorage keeps them in memory.
+type Storage interface {
+	Now() time.Time
+
+	WriteWindowKeys(keys int, app, title, project string) error
+	InsertKeyRows(rows []KeyRow) error
+	KeyCountsAfterId(id int64) ([]KeyRow, error)
+	GetLastKeyPress() (*time.Time, int64, error)
+	TotalKeys() (int64, error)
+
+	TotalCount(from, to time.Time) (int64, error)
+	RangeCounts(from, to time.Time, bucket string, loc *time.Location, newDayHour int) ([]RangeCount, error)
+	DailyCounts(days int, newDayHour int, now time.Time) ([]DailyCount, error)
+	HourlyCounts(hours int, dayOffset int, now time.Time) ([]HourlyCount, error)
+	HourlyCountsForDate(date string, loc *time.Location) ([]HourlyCount, error)
+	YearlyCounts(year int, newDayHour int, loc *time.Location) ([]DailyCount, error)
+	WeeklyHourlyGrid(now time.Time) (*WeeklyHeatmapResponse, error)
+	Stats(threshold int64, newDayHour int, now time.Time) (*Stats, error)
+	ProjectCounts(from, to time.Time) ([]ProjectCount, error)
+	Timesheet(from, to time.Time, newDayHour int, sessionIdle time.Duration, round int64, project string) (*Timesheet, error)
+	EvaluateGoals(goals []GoalConfig, newDayHour int, now time.Time) ([]GoalProgress, error)
+	UpdateGoals(goals []GoalConfig, newDayHour int, now time.Time) ([]GoalProgress, error)
+
+	AddAnnotation(annotation *Annotation) error
+	Annotations(from, to time.Time, loc *time.Location) ([]Annotation, error)
+	DeleteAnnotation(id int64) (bool, error)
+
+	SyncStatus() (*SyncStatus, error)
+}
+
+// SyncStorage is a Storage with an outbox of rows to send to a remote
+type SyncStorage interface {
+	Storage
+
+	EnqueueSyncRows(url string, remoteMaxId int64, chunkSize int) error
+	PendingSyncChunks() ([]SyncChunk, error)
+	KeyCountsInIdRange(first, last int64) ([]KeyRow, error)
+	AckSyncChunk(id int64) error
+	FailSyncChunk(id int64, syncErr error) error
+	RecordSyncAttempt(syncErr error) error
+}
+
+var (
+	_ SyncStorage = (*WatchStorage)(nil)
+	_ SyncStorage = (*MemoryStorage)(nil)
+)
+
+// minuteSource is what a backend provides for keys to be aggregated: the
+// keys stored in [from, to) per interval of grain, keyed by the start of the
+// interval in UTC. Grains divide an hour.
+type minuteSource interface {
+	filteredCounts(from, to time.Time, grain time.Duration, filter keyFilter) (map[time.Time]int64, error)
+	// keys without a project are counted under an empty one
+	projectMinuteCounts(from, to time.Time) (map[time.Time]map[string]int64, error)
+}
+
+// keyCounts implements the aggregation queries of Storage on top of a
+// backend's minute counts, so every backend counts the same way
+type keyCounts struct {
+	source minuteSource
+}
+
+// minuteCounts returns the keys stored per minute in [from, to)
+func (c keyCounts) minuteCounts(from, to time.Time) (map[time.Time]int64, error) {
+	return c.source.filteredCounts(from, to, time.Minute, keyFilter{})
+}
+
+// hourCounts returns the keys stored in [from, to) per interval small enough
+// for each one to fall within a single hour in loc, see zoneGrain
+func (c keyCounts) hourCounts(from, to time.Time, loc *time.Location) (map[time.Time]int64, error) {
+	return c.source.filteredCounts(from, to, zoneGrain(loc, from, to), keyFilter{})
+}
+
+// zoneGrain returns an hour, unless loc is offset from UTC by a fraction of
+// an hour at some point in [from, to). Those offsets are all multiples of 15
+// minutes.
+func zoneGrain(loc *time.Location, from, to time.Time) time.Duration {
+	for t := from; t.Before(to); t = t.AddDate(0, 0, 1) {
+		if _, offset := t.In(loc).Zone(); offset%3600 != 0 {
+			return 15 * time.Minute
+		}
+	}
+
+	if _, offset := to.In(loc).Zone(); offset%3600 != 0 {
+		return 15 * time.Minute
+	}
+
+	return time.Hour
+}
@@ -0,0 +1,159 @@
+package selfwatch
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maxPendingWrites is how many rows a BatchWriter keeps waiting after failed
+// writes before dropping the oldest
+const maxPendingWrites = 10000
+
+// BatchWriter buffers writes of keys and stores them together in a single
+// transaction, once size rows are waiting or every interval. Rows keep the
+// time they were written to the BatchWriter, not the time they were stored.
+type BatchWriter struct {
+	storage *WatchStorage
+	size    int
+	// rows waiting after failed writes are dropped past this, oldest first
+	maxPending int
+
+	mu      sync.Mutex
+	pending []keyWrite
+	// how many rows at the start of pending already failed to be written
+	failed int
+
+	// held while writing so batches are stored in order
+	flushMu sync.Mutex
+
+	// written is called with the rows stored by a flush, or with the rows
+	// that failed for the first time when it fails
+	written func(rows []keyWrite, err error)
+
+	// full wakes the background flush when size rows are waiting
+	full      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBatchWriter creates a BatchWriter for the storage. When interval is 0
+// rows are only stored once size are waiting, or by calling Flush.
+func (s *WatchStorage) NewBatchWriter(size int, interval time.Duration) *BatchWriter {
+	b := &BatchWriter{
+		storage:    s,
+		size:       size,
+		maxPending: maxPendingWrites,
+		full:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	if interval <= 0 {
+		close(b.stopped)
+		return b
+	}
+
+	go func() {
+		defer close(b.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.full:
+			case <-b.done:
+				return
+			}
+
+			if err := b.Flush(); err != nil {
+				log.Printf("Error writing keys: %v", err)
+			}
+		}
+	}()
+
+	return b
+}
+
+func (b *BatchWriter) WriteKeys(keys int) error {
+	return b.WriteWindowKeys(keys, "", "", "")
+}
+
+// WriteWindowKeys queues keys typed into a window with the given class and
+// title, classified as project. A full batch is stored in the background when
+// flushing every interval, otherwise it's stored right away and the error of
+// storing it is returned.
+func (b *BatchWriter) WriteWindowKeys(keys int, app, title, project string) error {
+	b.mu.Lock()
+	b.pending = append(b.pending, keyWrite{b.storage.Now(), keys, app, title, project})
+	full := len(b.pending) >= b.size
+	b.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+
+	select {
+	case <-b.stopped:
+		return b.Flush()
+	default:
+	}
+
+	select {
+	case b.full <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush stores every queued row. If the write fails the rows stay queued
+// for the next flush, up to maxPending of them.
+func (b *BatchWriter) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	pending := b.pending
+	failed := b.failed
+	b.pending = nil
+	b.failed = 0
+	b.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := b.storage.writeKeys(pending)
+	if err != nil {
+		if b.written != nil && failed < len(pending) {
+			b.written(pending[failed:], err)
+		}
+
+		b.mu.Lock()
+		b.pending = append(pending, b.pending...)
+		b.failed = len(pending)
+		if dropped := len(b.pending) - b.maxPending; dropped > 0 {
+			log.Printf("Dropping %d rows of keys that couldn't be written", dropped)
+			b.pending = b.pending[dropped:]
+			b.failed = max(b.failed-dropped, 0)
+		}
+		b.mu.Unlock()
+		return err
+	}
+
+	if b.written != nil {
+		b.written(pending, nil)
+	}
+
+	return nil
+}
+
+// Close stops flushing every interval and stores the queued rows
+func (b *BatchWriter) Close() error {
+	b.closeOnce.Do(func() { close(b.done) })
+	<-b.stopped
+	return b.Flush()
+}
@@ -0,0 +1,313 @@
+package selfwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Pauses in input long enough to count as a break. Times are stored as UTC
+// text like keys.created_at, rows written before that are converted.
+var breaksSchema = `
+CREATE TABLE IF NOT EXISTS breaks (
+	id INTEGER NOT NULL,
+	started_at DATETIME NOT NULL,
+	ended_at DATETIME NOT NULL,
+	kind TEXT NOT NULL,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS ix_breaks_started_at ON breaks (started_at);
+UPDATE breaks SET started_at = datetime(started_at), ended_at = datetime(ended_at)
+	WHERE length(started_at) > 19 OR length(ended_at) > 19;
+`
+
+const (
+	BreakKindMicro = "micro"
+	BreakKindFull  = "break"
+
+	// reasons a break reminder is sent
+	BreakReasonContinuous = "continuous"
+	BreakReasonRate       = "rate"
+)
+
+// BreakAlert describes an overdue break
+type BreakAlert struct {
+	Event         string    `json:"event"`
+	Reason        string    `json:"reason"`
+	Time          time.Time `json:"time"`
+	ActiveMinutes float64   `json:"active_minutes"`
+	KeysPerMinute int       `json:"keys_per_minute"`
+}
+
+func (a BreakAlert) message() string {
+	if a.Reason == BreakReasonRate {
+		return fmt.Sprintf("You typed %d keys in the last minute, slow down and take a break", a.KeysPerMinute)
+	}
+	return fmt.Sprintf("You have been active for %.0f minutes, time for a break", a.ActiveMinutes)
+}
+
+// BreakMonitor watches input for continuous activity without a break and
+// for high typing rates, reminding to take a break with the configured
+// actions. Pauses are recorded to storage as micro-breaks or breaks.
+type BreakMonitor struct {
+	// reminds once input has continued this long without a full break
+	After time.Duration
+	// a pause at least this long resets the active time
+	BreakLength time.Duration
+	// a longer pause is time away and isn't recorded, 0 records every pause
+	MaxBreak time.Duration
+	// a pause at least this long is recorded as a micro-break
+	MicroBreak time.Duration
+	// repeat reminders this often while a break is overdue
+	RemindEvery time.Duration
+	// reminds if more keys than this are typed in a minute, 0 disables
+	MaxKeysPerMinute int
+
+	Command    string
+	Notify     bool
+	WebhookUrl string
+	Client     *http.Client
+
+	Storage *WatchStorage
+
+	mu             sync.Mutex
+	activeSince    time.Time
+	lastInput      time.Time
+	lastAlert      time.Time
+	lastRateAlert  time.Time
+	recentKeyTimes []time.Time
+
+	// alert is called for every reminder and record for every pause worth
+	// recording, they must not block
+	alert  func(BreakAlert)
+	record func(start, end time.Time, kind string)
+}
+
+// NewBreakMonitor creates a monitor from the config, nil if break reminders
+// are disabled
+func NewBreakMonitor(c *config, storage *WatchStorage) *BreakMonitor {
+	if c.BreakAfterMinutes <= 0 && c.BreakMaxKeysPerMinute <= 0 {
+		return nil
+	}
+
+	minutes := func(m float64) time.Duration {
+		return time.Duration(m * float64(time.Minute))
+	}
+
+	m := &BreakMonitor{
+		After:            minutes(c.BreakAfterMinutes),
+		BreakLength:      minutes(c.BreakMinutes),
+		MaxBreak:         minutes(c.BreakMaxMinutes),
+		MicroBreak:       time.Duration(c.MicroBreakSeconds * float64(time.Second)),
+		RemindEvery:      minutes(c.BreakRemindMinutes),
+		MaxKeysPerMinute: c.BreakMaxKeysPerMinute,
+		Command:          c.BreakCommand,
+		Notify:           c.BreakNotify,
+		WebhookUrl:       c.BreakWebhookUrl,
+		Client:           &http.Client{Timeout: 10 * time.Second},
+		Storage:          storage,
+	}
+	m.alert = func(alert BreakAlert) {
+		go m.runActions(alert)
+	}
+	m.record = func(start, end time.Time, kind string) {
+		go m.recordBreak(start, end, kind)
+	}
+
+	return m
+}
+
+// Bind watches key presses and clicks from recorder, wrapping its existing
+// callbacks
+func (m *BreakMonitor) Bind(recorder *Recorder) {
+	keyRelease := recorder.KeyRelease
+	recorder.KeyRelease = func(event Event) {
+		m.input(time.Now(), true)
+		if keyRelease != nil {
+			keyRelease(event)
+		}
+	}
+
+	buttonRelease := recorder.ButtonRelease
+	recorder.ButtonRelease = func(event Event) {
+		m.input(time.Now(), false)
+		if buttonRelease != nil {
+			buttonRelease(event)
+		}
+	}
+}
+
+func (m *BreakMonitor) input(now time.Time, key bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.lastInput.IsZero() {
+		pause := now.Sub(m.lastInput)
+
+		away := m.MaxBreak > 0 && pause > m.MaxBreak
+		if m.MicroBreak > 0 && pause >= m.MicroBreak && !away {
+			kind := BreakKindMicro
+			if pause >= m.BreakLength {
+				kind = BreakKindFull
+			}
+
+			if m.record != nil {
+				m.record(m.lastInput, now, kind)
+			}
+		}
+
+		if pause >= m.BreakLength {
+			m.activeSince = time.Time{}
+			m.lastAlert = time.Time{}
+		}
+	}
+
+	if m.activeSince.IsZero() {
+		m.activeSince = now
+	}
+	m.lastInput = now
+
+	active := now.Sub(m.activeSince)
+
+	if m.After > 0 && active >= m.After && (m.lastAlert.IsZero() || now.Sub(m.lastAlert) >= m.RemindEvery) {
+		m.lastAlert = now
+		m.sendAlert(BreakAlert{
+			Reason:        BreakReasonContinuous,
+			Time:          now,
+			ActiveMinutes: active.Minutes(),
+		})
+	}
+
+	if !key || m.MaxKeysPerMinute <= 0 {
+		return
+	}
+
+	// keep the times of the keys typed in the last minute
+	m.recentKeyTimes = append(m.recentKeyTimes, now)
+	for len(m.recentKeyTimes) > 0 && now.Sub(m.recentKeyTimes[0]) > time.Minute {
+		m.recentKeyTimes = m.recentKeyTimes[1:]
+	}
+
+	rate := len(m.recentKeyTimes)
+	if rate > m.MaxKeysPerMinute && (m.lastRateAlert.IsZero() || now.Sub(m.lastRateAlert) >= m.RemindEvery) {
+		m.lastRateAlert = now
+		m.sendAlert(BreakAlert{
+			Reason:        BreakReasonRate,
+			Time:          now,
+			ActiveMinutes: active.Minutes(),
+			KeysPerMinute: rate,
+		})
+	}
+}
+
+func (m *BreakMonitor) recordBreak(start, end time.Time, kind string) {
+	if m.Storage == nil {
+		return
+	}
+
+	if err := m.Storage.RecordBreak(start, end, kind); err != nil {
+		log.Printf("Error recording break: %v", err)
+	}
+}
+
+func (m *BreakMonitor) sendAlert(alert BreakAlert) {
+	alert.Event = "break_overdue"
+	log.Print("Break reminder: ", alert.message())
+	if m.alert != nil {
+		m.alert(alert)
+	}
+}
+
+// runActions runs every configured action for alert
+func (m *BreakMonitor) runActions(alert BreakAlert) {
+	if m.Command != "" {
+		cmd := exec.Command("sh", "-c", m.Command)
+		cmd.Env = append(os.Environ(),
+			"SELFWATCH_BREAK_REASON="+alert.Reason,
+			fmt.Sprintf("SELFWATCH_ACTIVE_MINUTES=%.0f", alert.ActiveMinutes),
+			fmt.Sprintf("SELFWATCH_KEYS_PER_MINUTE=%d", alert.KeysPerMinute),
+		)
+		if err := cmd.Run(); err != nil {
+			log.Printf("Error running break command: %v", err)
+		}
+	}
+
+	// notify-send delivers the notification over D-Bus
+	if m.Notify {
+		err := exec.Command("notify-send", "--app-name=selfwatch", "--urgency=critical",
+			"Take a break", alert.message()).Run()
+		if err != nil {
+			log.Printf("Error sending break notification: %v", err)
+		}
+	}
+
+	if m.WebhookUrl != "" {
+		payload, err := json.Marshal(alert)
+		if err != nil {
+			log.Printf("Error sending break webhook: %v", err)
+			return
+		}
+
+		client := m.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+
+		res, err := client.Post(m.WebhookUrl, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("Error sending break webhook: %v", err)
+			return
+		}
+		res.Body.Close()
+	}
+}
+
+func (s *WatchStorage) RecordBreak(start, end time.Time, kind string) error {
+	const sqlTime = "2006-01-02 15:04:05"
+	_, err := s.db.Exec(`insert into breaks(started_at, ended_at, kind) values(?, ?, ?)`,
+		start.UTC().Format(sqlTime), end.UTC().Format(sqlTime), kind)
+	return err
+}
+
+type BreakCount struct {
+	Kind    string  `json:"kind"`
+	Count   int64   `json:"count"`
+	Minutes float64 `json:"minutes"`
+}
+
+// BreakCounts summarizes the breaks that started in [from, to) by kind
+func (s *WatchStorage) BreakCounts(from, to time.Time) ([]BreakCount, error) {
+	const sqlTime = "2006-01-02 15:04:05"
+
+	rows, err := s.db.Query(`
+		select kind, count(*),
+			sum(strftime('%s', ended_at) - strftime('%s', started_at)) / 60.0
+		from breaks
+		where started_at >= ? and started_at < ?
+		group by 1
+		order by 1;
+	`, from.UTC().Format(sqlTime), to.UTC().Format(sqlTime))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	out := make([]BreakCount, 0)
+	for rows.Next() {
+		var count BreakCount
+		if err = rows.Scan(&count.Kind, &count.Count, &count.Minutes); err != nil {
+			return nil, err
+		}
+		out = append(out, count)
+	}
+
+	return out, nil
+}
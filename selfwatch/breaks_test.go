@@ -0,0 +1,139 @@
+package selfwatch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakMonitor(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	var alerts []BreakAlert
+	monitor := &BreakMonitor{
+		After:            30 * time.Minute,
+		BreakLength:      5 * time.Minute,
+		MaxBreak:         time.Hour,
+		MicroBreak:       30 * time.Second,
+		RemindEvery:      10 * time.Minute,
+		MaxKeysPerMinute: 100,
+		Storage:          storage,
+	}
+	monitor.alert = func(alert BreakAlert) {
+		alerts = append(alerts, alert)
+	}
+	monitor.record = monitor.recordBreak
+
+	start := time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	// type a key every 10 seconds for 45 minutes, with one 40 second pause
+	now := start
+	for now.Before(start.Add(45 * time.Minute)) {
+		monitor.input(now, true)
+		now = now.Add(10 * time.Second)
+		if now.Equal(start.Add(20 * time.Minute)) {
+			now = now.Add(40 * time.Second)
+		}
+	}
+
+	// reminded at 30 and 40 minutes, a micro-break doesn't reset active time
+	if len(alerts) != 2 || alerts[0].Reason != BreakReasonContinuous {
+		t.Fatalf("Expected two break reminders, got %+v", alerts)
+	}
+
+	if alerts[0].Time.Sub(start) != 30*time.Minute || alerts[1].Time.Sub(start) != 40*time.Minute {
+		t.Fatalf("Unexpected reminder times %v, %v", alerts[0].Time.Sub(start), alerts[1].Time.Sub(start))
+	}
+
+	// a full break resets the active time
+	now = now.Add(6 * time.Minute)
+	monitor.input(now, true)
+
+	if !monitor.activeSince.Equal(now) {
+		t.Fatal("Expected a full break to reset the active time")
+	}
+
+	counts, err := storage.BreakCounts(start, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(counts) != 2 || counts[0].Kind != BreakKindFull || counts[1].Kind != BreakKindMicro {
+		t.Fatalf("Expected one break and one micro-break, got %+v", counts)
+	}
+
+	// a pause longer than MaxBreak resets the active time without being
+	// recorded
+	away := now
+	now = now.Add(8 * time.Hour)
+	monitor.input(now, true)
+
+	if !monitor.activeSince.Equal(now) {
+		t.Fatal("Expected time away to reset the active time")
+	}
+
+	counts, err = storage.BreakCounts(away, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(counts) != 0 {
+		t.Fatalf("Expected time away not to be recorded, got %+v", counts)
+	}
+
+	// typing fast triggers a rate reminder
+	alerts = nil
+	for i := 0; i < 120; i++ {
+		monitor.input(now.Add(time.Duration(i)*100*time.Millisecond), true)
+	}
+
+	if len(alerts) != 1 || alerts[0].Reason != BreakReasonRate || alerts[0].KeysPerMinute != 101 {
+		t.Fatalf("Expected one rate reminder, got %+v", alerts)
+	}
+}
+
+func TestBreakCountsZones(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+	loc := mustLoadLocation("America/New_York")
+
+	start := time.Date(2024, 3, 2, 10, 0, 0, 0, loc)
+	if err := storage.RecordBreak(start, start.Add(6*time.Minute), BreakKindFull); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a row written before times were stored as UTC text
+	if _, err := storage.db.Exec(`insert into breaks(started_at, ended_at, kind) values(?, ?, ?)`,
+		start.Add(time.Hour), start.Add(time.Hour+time.Minute), BreakKindMicro); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := storage.UpdateSchema(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var startedAt string
+	if err := storage.db.QueryRow(`select cast(started_at as text) from breaks order by id limit 1`).Scan(&startedAt); err != nil {
+		t.Fatal(err.Error())
+	}
+	if startedAt != "2024-03-02 15:00:00" {
+		t.Fatalf("Expected the break to be stored as UTC text, got %s", startedAt)
+	}
+
+	counts, err := storage.BreakCounts(start.In(time.UTC), start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(counts) != 2 || counts[0].Minutes != 6 || counts[1].Minutes != 1 {
+		t.Fatalf("Expected one break and one micro-break, got %+v", counts)
+	}
+
+	// the range excludes its end
+	counts, err = storage.BreakCounts(start.Add(-time.Hour), start)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(counts) != 0 {
+		t.Fatalf("Expected no breaks before the start, got %+v", counts)
+	}
+}
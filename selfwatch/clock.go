@@ -0,0 +1,30 @@
+package selfwatch
+
+import "time"
+
+// Clock tells storage what time it is, so keys can be written and counted at
+// fixed times in tests
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the default clock, returning the current time
+var SystemClock Clock = ClockFunc(time.Now)
+
+// SetClock replaces the clock used for every time written and every period
+// counted up to now
+func (s *WatchStorage) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// Now returns the current time according to the storage's clock
+func (s *WatchStorage) Now() time.Time {
+	return s.clock.Now()
+}
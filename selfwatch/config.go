@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const DefaultConfigFname = "~/.selfwatch/config.json"
@@ -15,6 +16,78 @@ type config struct {
 	RemoteFlushDelay float64
 	SyncDelay        float64
 	NewDayHour       int
+	// IANA time zone days and hours are counted in, eg. "Europe/Berlin".
+	// Defaults to the system's local time zone.
+	Timezone string
+
+	// minutes without input after which an activity session ends
+	SessionIdleMinutes float64
+	// keys needed in a day for it to count towards a streak
+	StreakThreshold int64
+
+	Goals []GoalConfig
+
+	// Projects classifies keys by the window they were typed into, the first
+	// matching rule wins
+	Projects []ProjectRule
+
+	// Break reminders, enabled by setting BreakAfterMinutes or
+	// BreakMaxKeysPerMinute
+	BreakAfterMinutes     float64
+	BreakMaxKeysPerMinute int
+	BreakMinutes          float64
+	BreakMaxMinutes       float64
+	MicroBreakSeconds     float64
+	BreakRemindMinutes    float64
+	BreakCommand          string
+	BreakNotify           bool
+	BreakWebhookUrl       string
+
+	// Webhooks are sent activity events from the recorder, failed deliveries
+	// are retried WebhookRetries times
+	Webhooks       []WebhookConfig
+	WebhookRetries int
+
+	// Remote sync authentication, shared by the sending and receiving side
+	RemoteToken    string
+	RemoteSecret   string
+	RemoteCertFile string
+	RemoteKeyFile  string
+	RemoteCAFile   string
+
+	// base64 encoded key used to encrypt sync chunks end to end
+	RemoteEncryptionKey string
+	// identifies this machine to the remote, defaults to the hostname
+	Host string
+
+	// Metrics exporters, each flush is pushed to every one configured
+	InfluxUrl         string
+	InfluxToken       string
+	InfluxMeasurement string
+	GraphiteAddr      string
+	GraphitePrefix    string
+
+	// address for the recorder to serve Prometheus metrics on, disabled if empty
+	MetricsAddr string
+
+	// Web dashboard authentication, HTTP basic auth if WebPassword is set and
+	// a login form if WebToken is set
+	WebUsername string
+	WebPassword string
+	WebToken    string
+
+	// Serve the web dashboard over HTTPS with the given certificate, or with
+	// a generated self signed one if WebTLS is set without them
+	WebCertFile string
+	WebKeyFile  string
+	WebTLS      bool
+	// octal permissions for the socket when listening on unix:/path
+	WebSocketMode string
+
+	// TLS for `selfwatch receive`, ReceiveClientCAFile enables mTLS
+	ReceiveCertFile     string
+	ReceiveKeyFile      string
+	ReceiveClientCAFile string
 }
 
 var defaultConfig = config{
@@ -23,6 +96,20 @@ var defaultConfig = config{
 	RemoteFlushDelay: 60,
 	SyncDelay:        60,
 	NewDayHour:       4,
+
+	SessionIdleMinutes: 5,
+	StreakThreshold:    1000,
+
+	BreakMinutes:       5,
+	BreakMaxMinutes:    60,
+	MicroBreakSeconds:  30,
+	BreakRemindMinutes: 10,
+
+	WebhookRetries: 3,
+
+	WebUsername: "selfwatch",
+
+	InfluxMeasurement: "selfwatch",
 }
 
 func expandHomePath(path string) (string, error) {
@@ -45,6 +132,36 @@ func (c *config) DbExists() bool {
 	return err == nil
 }
 
+func (c *config) HostId() string {
+	if c.Host != "" {
+		return c.Host
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// Location returns the configured time zone, or the local one if it isn't
+// set or can't be loaded
+func (c *config) Location() *time.Location {
+	if c.Timezone == "" {
+		return time.Local
+	}
+
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		log.Printf("Invalid Timezone %q: %v", c.Timezone, err)
+		return time.Local
+	}
+	return loc
+}
+
+func (c *config) SessionIdle() time.Duration {
+	return time.Duration(c.SessionIdleMinutes * float64(time.Minute))
+}
+
 func LoadConfig(fname string) *config {
 	c := defaultConfig
 
@@ -66,6 +183,12 @@ func LoadConfig(fname string) *config {
 		if err != nil {
 			log.Fatal("Failed parsing config: ", fname, ": ", err.Error())
 		}
+
+		if c.Timezone != "" {
+			if _, err := time.LoadLocation(c.Timezone); err != nil {
+				log.Fatal("Invalid Timezone in config: ", fname, ": ", err.Error())
+			}
+		}
 	} else {
 		log.Print(err.Error())
 	}
@@ -0,0 +1,193 @@
+package selfwatch
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Bucket sizes accepted by RangeCounts
+const (
+	BucketMinute = "minute"
+	BucketHour   = "hour"
+	BucketDay    = "day"
+	BucketWeek   = "week"
+	BucketMonth  = "month"
+	BucketYear   = "year"
+)
+
+// maxBucketDays limits how many days /api/counts covers for each bucket
+// size, every hour in the range is read no matter how large the buckets are
+var maxBucketDays = map[string]int{
+	BucketMinute: 7,
+	BucketHour:   366,
+	BucketDay:    10 * 366,
+	BucketWeek:   100 * 366,
+	BucketMonth:  100 * 366,
+	BucketYear:   100 * 366,
+}
+
+type RangeCount struct {
+	Bucket string `json:"bucket"`
+	Count  int64  `json:"count"`
+}
+
+func IsValidBucket(bucket string) bool {
+	switch bucket {
+	case BucketMinute, BucketHour, BucketDay, BucketWeek, BucketMonth, BucketYear:
+		return true
+	}
+	return false
+}
+
+// bucketKey returns the label of the bucket t falls in. Day and larger
+// buckets start at newDayHour. Weeks start on Monday and are labeled with
+// the date they start on.
+func bucketKey(t time.Time, bucket string, newDayHour int) string {
+	switch bucket {
+	case BucketMinute:
+		return t.Format("2006-01-02 15:04")
+	case BucketHour:
+		return t.Format("2006-01-02 15")
+	}
+
+	day := logicalDate(t, newDayHour)
+
+	switch bucket {
+	case BucketWeek:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset).Format("2006-01-02")
+	case BucketMonth:
+		return day.Format("2006-01")
+	case BucketYear:
+		return day.Format("2006")
+	default:
+		return day.Format("2006-01-02")
+	}
+}
+
+// logicalDate returns noon of the day t belongs to, given days start at
+// newDayHour on the wall clock. Comparing wall clock hours keeps days right
+// across daylight saving changes, and noon exists on every day.
+func logicalDate(t time.Time, newDayHour int) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, t.Location())
+	if t.Hour() < newDayHour {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day
+}
+
+// LogicalDayStart returns when the day containing t started, in t's
+// location, given days start at newDayHour
+func LogicalDayStart(t time.Time, newDayHour int) time.Time {
+	return DayStart(logicalDate(t, newDayHour), newDayHour)
+}
+
+// DayStart returns when the day on date's calendar date starts, in its
+// location, given days start at newDayHour
+func DayStart(date time.Time, newDayHour int) time.Time {
+	start := time.Date(date.Year(), date.Month(), date.Day(), newDayHour, 0, 0, 0, date.Location())
+
+	// when clocks skip over newDayHour the day starts as they go forward
+	for start.Hour() < newDayHour && start.Day() == date.Day() {
+		start = start.Add(time.Minute)
+	}
+	return start
+}
+
+// TotalCount sums keys in [from, to)
+func (c keyCounts) TotalCount(from, to time.Time) (int64, error) {
+	hours, err := c.source.filteredCounts(from, to, time.Hour, keyFilter{})
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, count := range hours {
+		total += count
+	}
+	return total, nil
+}
+
+// keyFilter restricts which rows are counted, empty fields match everything
+type keyFilter struct {
+	App string
+}
+
+// createdBetween matches keys created in [from, to), with the arguments from
+// createdBetweenArgs. created_at is stored as UTC text so the comparison can
+// use its index.
+const createdBetween = `created_at >= ? and created_at < ?`
+
+func createdBetweenArgs(from, to time.Time) []interface{} {
+	const sqlTime = "2006-01-02 15:04:05"
+	return []interface{}{from.UTC().Format(sqlTime), to.UTC().Format(sqlTime)}
+}
+
+func (s *WatchStorage) filteredCounts(from, to time.Time, grain time.Duration, filter keyFilter) (map[time.Time]int64, error) {
+	seconds := int64(grain / time.Second)
+
+	rows, err := s.db.Query(`
+		select cast(strftime('%s', created_at) as integer) / ? * ?, sum(nrkeys)
+		from keys
+		where `+createdBetween+`
+			and (? = '' or window_class = ?)
+		group by 1;
+	`, append(append([]interface{}{seconds, seconds}, createdBetweenArgs(from, to)...), filter.App, filter.App)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	out := make(map[time.Time]int64)
+
+	for rows.Next() {
+		var start, count int64
+
+		if err = rows.Scan(&start, &count); err != nil {
+			return nil, err
+		}
+
+		out[time.Unix(start, 0).UTC()] += count
+	}
+
+	return out, rows.Err()
+}
+
+// RangeCounts sums keys in [from, to) into buckets in the given location.
+// Buckets without any keys are omitted.
+func (c keyCounts) RangeCounts(from, to time.Time, bucket string, loc *time.Location, newDayHour int) ([]RangeCount, error) {
+	if !IsValidBucket(bucket) {
+		return nil, fmt.Errorf("invalid bucket: %s", bucket)
+	}
+
+	var counts map[time.Time]int64
+	var err error
+	if bucket == BucketMinute {
+		counts, err = c.minuteCounts(from, to)
+	} else {
+		counts, err = c.hourCounts(from, to, loc)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]int64)
+	for start, count := range counts {
+		sums[bucketKey(start.In(loc), bucket, newDayHour)] += count
+	}
+
+	out := make([]RangeCount, 0, len(sums))
+	for key, count := range sums {
+		out = append(out, RangeCount{Bucket: key, Count: count})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Bucket < out[j].Bucket
+	})
+
+	return out, nil
+}
@@ -0,0 +1,361 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// countsFixtureNow is the time counts are checked at, a Wednesday three days
+// after clocks went forward in New York
+var countsFixtureNow = time.Date(2024, 3, 13, 12, 0, 0, 0, mustLoadLocation("America/New_York"))
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// newCountsFixture writes keys at fixed times around the edges of days,
+// years and a daylight saving change, then sets the clock to
+// countsFixtureNow
+func newCountsFixture(t *testing.T) *WatchStorage {
+	storage := newTestStorage(t, testDbName)
+	storage.SetClock(writeCountsFixture(t, storage))
+	return storage
+}
+
+// writeCountsFixture writes the keys through a clock that moves to each
+// fixture's time, and returns a clock stopped at countsFixtureNow
+func writeCountsFixture(t *testing.T, storage interface {
+	Storage
+	SetClock(Clock)
+}) Clock {
+	loc := countsFixtureNow.Location()
+
+	var now time.Time
+	storage.SetClock(ClockFunc(func() time.Time { return now }))
+
+	fixtures := []struct {
+		time time.Time
+		keys int
+	}{
+		{time.Date(2024, 3, 13, 11, 59, 30, 0, loc), 1},
+		// exactly when the day starts with a NewDayHour of 4, and a second
+		// before
+		{time.Date(2024, 3, 13, 4, 0, 0, 0, loc), 2},
+		{time.Date(2024, 3, 13, 3, 59, 59, 0, loc), 4},
+		{time.Date(2024, 3, 12, 0, 0, 0, 0, loc), 8},
+		// an hour after clocks went from 2:00 to 3:00
+		{time.Date(2024, 3, 10, 3, 30, 0, 0, loc), 16},
+		// exactly a week before now, and a minute before that
+		{time.Date(2024, 3, 6, 12, 0, 0, 0, loc), 32},
+		{time.Date(2024, 3, 6, 11, 59, 0, 0, loc), 64},
+		// the last day of 2023 lasts until 4:00 on January 1st
+		{time.Date(2023, 12, 31, 23, 30, 0, 0, loc), 128},
+		{time.Date(2024, 1, 1, 2, 0, 0, 0, loc), 256},
+		{time.Date(2024, 1, 1, 4, 0, 0, 0, loc), 512},
+	}
+
+	for _, fixture := range fixtures {
+		now = fixture.time
+		if err := storage.WriteWindowKeys(fixture.keys, "", "", ""); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	return ClockFunc(func() time.Time { return countsFixtureNow })
+}
+
+func TestLogicalDayStart(t *testing.T) {
+	loc := countsFixtureNow.Location()
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, loc)
+	}
+
+	days := []struct {
+		time       time.Time
+		newDayHour int
+		start      time.Time
+		key        string
+	}{
+		{at(3, 13, 12, 0), 0, at(3, 13, 0, 0), "2024-03-13"},
+		{at(3, 13, 0, 0), 0, at(3, 13, 0, 0), "2024-03-13"},
+		{at(3, 13, 4, 0), 4, at(3, 13, 4, 0), "2024-03-13"},
+		{at(3, 13, 3, 59), 4, at(3, 12, 4, 0), "2024-03-12"},
+		{at(3, 13, 22, 59), 23, at(3, 12, 23, 0), "2024-03-12"},
+		{at(3, 13, 23, 0), 23, at(3, 13, 23, 0), "2024-03-13"},
+		{at(1, 1, 2, 0), 4, time.Date(2023, 12, 31, 4, 0, 0, 0, loc), "2023-12-31"},
+		// 4:00 on the wall clock, three hours after midnight when clocks go
+		// forward and five when they go back
+		{at(3, 10, 3, 30), 4, at(3, 9, 4, 0), "2024-03-09"},
+		{at(3, 10, 4, 0), 4, at(3, 10, 4, 0), "2024-03-10"},
+		{at(11, 3, 3, 59), 4, at(11, 2, 4, 0), "2024-11-02"},
+		{at(11, 3, 4, 0), 4, at(11, 3, 4, 0), "2024-11-03"},
+		// 2:00 doesn't exist when clocks go forward, the day starts at 3:00
+		{at(3, 10, 12, 0), 2, at(3, 10, 3, 0), "2024-03-10"},
+	}
+
+	for _, day := range days {
+		if start := LogicalDayStart(day.time, day.newDayHour); !start.Equal(day.start) {
+			t.Fatalf("%v with NewDayHour %d: expected the day to start at %v, got %v", day.time, day.newDayHour, day.start, start)
+		}
+
+		if key := bucketKey(day.time, BucketDay, day.newDayHour); key != day.key {
+			t.Fatalf("%v with NewDayHour %d: expected day %s, got %s", day.time, day.newDayHour, day.key, key)
+		}
+	}
+}
+
+func TestDailyCounts(t *testing.T) {
+	storage := newCountsFixture(t)
+	now := storage.Now()
+
+	counts, err := storage.DailyCounts(7, 4, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []DailyCount{
+		{"2024-03-06", 32},
+		{"2024-03-09", 16},
+		{"2024-03-11", 8},
+		{"2024-03-12", 4},
+		{"2024-03-13", 3},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+
+	counts, err = storage.DailyCounts(7, 0, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected = []DailyCount{
+		{"2024-03-06", 32},
+		{"2024-03-10", 16},
+		{"2024-03-12", 8},
+		{"2024-03-13", 7},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+
+	// the same keys are on different days in another time zone
+	counts, err = storage.DailyCounts(1, 0, now.In(time.UTC))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected = []DailyCount{{"2024-03-13", 7}}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+}
+
+func TestHourlyCounts(t *testing.T) {
+	storage := newCountsFixture(t)
+	now := storage.Now()
+
+	expect := func(dayOffset int, expected []HourlyCount) {
+		t.Helper()
+
+		counts, err := storage.HourlyCounts(24, dayOffset, now)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(counts, expected) {
+			t.Fatalf("Offset %d: expected %v, got %v", dayOffset, expected, counts)
+		}
+	}
+
+	expect(0, []HourlyCount{
+		{"2024-03-13 03", 4},
+		{"2024-03-13 04", 2},
+		{"2024-03-13 11", 1},
+	})
+
+	expect(1, []HourlyCount{{"2024-03-12 00", 8}})
+	expect(2, []HourlyCount{})
+	expect(3, []HourlyCount{{"2024-03-10 03", 16}})
+
+	counts, err := storage.HourlyCountsForDate("2024-03-13", now.Location())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []HourlyCount{
+		{"2024-03-13 03", 4},
+		{"2024-03-13 04", 2},
+		{"2024-03-13 11", 1},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+
+	if _, err := storage.HourlyCountsForDate("March 13", now.Location()); err == nil {
+		t.Fatal("Expected an error for an invalid date")
+	}
+}
+
+func TestHourlyCountsPartialHourZone(t *testing.T) {
+	storage := newCountsFixture(t)
+
+	// Kathmandu is 5:45 ahead of UTC, so 3:59:59 in New York is in the same
+	// hour there as 4:00 even though they are in different UTC hours
+	loc := mustLoadLocation("Asia/Kathmandu")
+	counts, err := storage.HourlyCountsForDate("2024-03-13", loc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []HourlyCount{
+		{"2024-03-13 13", 6},
+		{"2024-03-13 21", 1},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+}
+
+func TestYearlyCounts(t *testing.T) {
+	storage := newCountsFixture(t)
+	loc := storage.Now().Location()
+
+	expect := func(year, newDayHour int, expected []DailyCount) {
+		t.Helper()
+
+		counts, err := storage.YearlyCounts(year, newDayHour, loc)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(counts, expected) {
+			t.Fatalf("%d with NewDayHour %d: expected %v, got %v", year, newDayHour, expected, counts)
+		}
+	}
+
+	expect(2023, 4, []DailyCount{{"2023-12-31", 384}})
+	expect(2023, 0, []DailyCount{{"2023-12-31", 128}})
+
+	expect(2024, 4, []DailyCount{
+		{"2024-01-01", 512},
+		{"2024-03-06", 96},
+		{"2024-03-09", 16},
+		{"2024-03-11", 8},
+		{"2024-03-12", 4},
+		{"2024-03-13", 3},
+	})
+
+	expect(2022, 4, []DailyCount{})
+}
+
+func TestWeeklyHourlyGrid(t *testing.T) {
+	storage := newCountsFixture(t)
+
+	grid, err := storage.WeeklyHourlyGrid(storage.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := &WeeklyHeatmapResponse{
+		StartDate: "2024-03-07",
+		EndDate:   "2024-03-13",
+		Data: []WeeklyHourlyCount{
+			{"2024-03-06", 12, 32},
+			{"2024-03-10", 3, 16},
+			{"2024-03-12", 0, 8},
+			{"2024-03-13", 3, 4},
+			{"2024-03-13", 4, 2},
+			{"2024-03-13", 11, 1},
+		},
+	}
+	if !reflect.DeepEqual(grid, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, grid)
+	}
+}
+
+func TestTotalCount(t *testing.T) {
+	storage := newCountsFixture(t)
+	now := storage.Now()
+
+	total, err := storage.TotalCount(LogicalDayStart(now, 4), now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total != 3 {
+		t.Fatalf("Expected 3 keys today, got %d", total)
+	}
+
+	total, err = storage.TotalCount(time.Unix(0, 0), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total != 1023 {
+		t.Fatalf("Expected 1023 keys in total, got %d", total)
+	}
+}
+
+func TestWebCountsClock(t *testing.T) {
+	storage := newCountsFixture(t)
+
+	cfg := defaultConfig
+	cfg.Timezone = "America/New_York"
+
+	handler, err := NewWebServer(storage, &cfg, "", "test", "today").Handler()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/daily")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var counts []DailyCount
+	json.NewDecoder(res.Body).Decode(&counts)
+	res.Body.Close()
+
+	// the last 30 days as of the storage's clock
+	expected := []DailyCount{
+		{"2024-03-06", 96},
+		{"2024-03-09", 16},
+		{"2024-03-11", 8},
+		{"2024-03-12", 4},
+		{"2024-03-13", 3},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, counts)
+	}
+}
+
+func TestWebCountsRangeLimit(t *testing.T) {
+	server := newTestWebServer(t, defaultConfig)
+	defer server.Close()
+
+	ranges := []struct {
+		query  string
+		status int
+	}{
+		{"from=2024-03-01&to=2024-03-07&bucket=minute", http.StatusOK},
+		{"from=2024-03-01&to=2024-03-08&bucket=minute", http.StatusBadRequest},
+		{"from=2024-01-01&to=2024-12-31&bucket=hour", http.StatusOK},
+		{"from=2000-01-01&to=2024-12-31&bucket=hour", http.StatusBadRequest},
+		{"from=2000-01-01&to=2024-12-31&bucket=day", http.StatusBadRequest},
+		{"from=2000-01-01&to=2024-12-31&bucket=month", http.StatusOK},
+		{"from=0001-01-01&to=2024-12-31&bucket=year", http.StatusBadRequest},
+	}
+
+	for _, r := range ranges {
+		res, err := http.Get(server.URL + "/api/counts?" + r.query)
+		expectStatus(t, res, err, r.status)
+	}
+}
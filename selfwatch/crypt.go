@@ -0,0 +1,83 @@
+package selfwatch
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+const encryptionHeader = "X-Selfwatch-Encryption"
+
+// name of the payload encryption scheme, sent in encryptionHeader
+const encryptionScheme = "aes-256-gcm"
+
+const encryptionKeySize = 32
+
+// GenerateEncryptionKey returns a new random key encoded for use as
+// RemoteEncryptionKey
+func GenerateEncryptionKey() (string, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseEncryptionKey decodes a base64 encoded 256 bit key
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("invalid encryption key: expected %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptPayload seals plaintext with a random nonce, which is prepended to
+// the returned ciphertext. lastRowId is the id sent in plaintext alongside
+// the chunk, it's authenticated so a relay can't change it without
+// decryption failing.
+func encryptPayload(key []byte, plaintext []byte, lastRowId string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, []byte(lastRowId)), nil
+}
+
+func decryptPayload(key []byte, ciphertext []byte, lastRowId string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted payload too short")
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, []byte(lastRowId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %v", err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,149 @@
+package selfwatch
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MetricsExporter pushes the key count of each flush to an external
+// time series database
+type MetricsExporter interface {
+	Export(flush FlushEvent) error
+}
+
+// InfluxExporter writes points using the InfluxDB HTTP line protocol. Url is
+// the full write endpoint, eg. http://localhost:8086/write?db=selfwatch or
+// http://localhost:8086/api/v2/write?org=me&bucket=selfwatch
+type InfluxExporter struct {
+	Url         string
+	Token       string
+	Measurement string
+	Host        string
+	// Client defaults to exporterClient
+	Client *http.Client
+}
+
+// exporterClient gives up on a stalled server the same as GraphiteExporter,
+// so exports don't pile up
+var exporterClient = &http.Client{Timeout: 10 * time.Second}
+
+// GraphiteExporter writes metrics to a carbon plaintext protocol listener
+type GraphiteExporter struct {
+	Addr   string
+	Prefix string
+}
+
+// NewMetricsExporters creates an exporter for every destination configured
+func NewMetricsExporters(c *config) []MetricsExporter {
+	var exporters []MetricsExporter
+
+	if c.InfluxUrl != "" {
+		exporters = append(exporters, &InfluxExporter{
+			Url:         c.InfluxUrl,
+			Token:       c.InfluxToken,
+			Measurement: c.InfluxMeasurement,
+			Host:        c.HostId(),
+		})
+	}
+
+	if c.GraphiteAddr != "" {
+		prefix := c.GraphitePrefix
+		if prefix == "" {
+			prefix = "selfwatch." + graphiteSafe(c.HostId())
+		}
+
+		exporters = append(exporters, &GraphiteExporter{
+			Addr:   c.GraphiteAddr,
+			Prefix: prefix,
+		})
+	}
+
+	return exporters
+}
+
+// BindExporter exports every successful flush of storage in the background
+func BindExporter(storage *WatchStorage, exporter MetricsExporter) {
+	storage.OnFlush(func(flush FlushEvent) {
+		if flush.Err != nil {
+			return
+		}
+
+		go func() {
+			if err := exporter.Export(flush); err != nil {
+				log.Printf("Error exporting metrics: %v", err)
+			}
+		}()
+	})
+}
+
+// escapes commas, spaces and equals signs in tag keys and values
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func (e *InfluxExporter) line(flush FlushEvent) string {
+	measurement := e.Measurement
+	if measurement == "" {
+		measurement = "selfwatch"
+	}
+
+	var line strings.Builder
+	line.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(measurement))
+	if e.Host != "" {
+		line.WriteString(",host=")
+		line.WriteString(influxTagEscaper.Replace(e.Host))
+	}
+	fmt.Fprintf(&line, " keys=%di %d\n", flush.Keys, flush.Time.UnixNano())
+	return line.String()
+}
+
+func (e *InfluxExporter) Export(flush FlushEvent) error {
+	req, err := http.NewRequest("POST", e.Url, bytes.NewBufferString(e.line(flush)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.Token)
+	}
+
+	client := e.Client
+	if client == nil {
+		client = exporterClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("influx returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// graphiteSafe replaces characters that have meaning in graphite paths
+func graphiteSafe(name string) string {
+	return strings.NewReplacer(".", "_", " ", "_").Replace(name)
+}
+
+func (e *GraphiteExporter) Export(flush FlushEvent) error {
+	conn, err := net.DialTimeout("tcp", e.Addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = fmt.Fprintf(conn, "%s.keys %d %d\n", e.Prefix, flush.Keys, flush.Time.Unix())
+	return err
+}
@@ -0,0 +1,81 @@
+package selfwatch
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testFlush = FlushEvent{
+	Time: time.Unix(1700000000, 0),
+	Keys: 42,
+}
+
+func TestInfluxExporter(t *testing.T) {
+	var body, auth string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	exporter := &InfluxExporter{
+		Url:         server.URL + "/write?db=selfwatch",
+		Token:       "secret",
+		Measurement: "selfwatch",
+		Host:        "my laptop",
+	}
+
+	if err := exporter.Export(testFlush); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := "selfwatch,host=my\\ laptop keys=42i 1700000000000000000\n"
+	if body != expected {
+		t.Fatalf("Expected %q, got %q", expected, body)
+	}
+
+	if auth != "Token secret" {
+		t.Fatalf("Expected token authorization, got %q", auth)
+	}
+}
+
+func TestGraphiteExporter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	exporter := &GraphiteExporter{
+		Addr:   listener.Addr().String(),
+		Prefix: "selfwatch.laptop",
+	}
+
+	if err := exporter.Export(testFlush); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := "selfwatch.laptop.keys 42 1700000000\n"
+	if line := <-received; line != expected {
+		t.Fatalf("Expected %q, got %q", expected, line)
+	}
+}
@@ -0,0 +1,276 @@
+package selfwatch
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Progress of every goal for each period it was evaluated in
+var goalsSchema = `
+CREATE TABLE IF NOT EXISTS goals (
+	id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	period_start TEXT NOT NULL,
+	metric TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	target INTEGER NOT NULL,
+	value INTEGER NOT NULL,
+	met INTEGER NOT NULL,
+	updated_at DATETIME,
+	PRIMARY KEY (id),
+	UNIQUE (name, period_start)
+);
+`
+
+const (
+	GoalMetricKeys          = "keys"
+	GoalMetricActiveMinutes = "active_minutes"
+
+	// min goals are met by reaching the target, max goals by staying under it
+	GoalKindMin = "min"
+	GoalKindMax = "max"
+)
+
+type GoalConfig struct {
+	Name string
+	// Metric is "keys" (default) or "active_minutes", minutes with any keys
+	Metric string
+	// set one of Min, to reach at least that much, or Max, to stay under it.
+	// A Max of 0 is a goal of not typing at all.
+	Min *int64
+	Max *int64
+	// Period is "day" (default) or "week"
+	Period string
+	// Weekdays limits a daily goal to some days, eg. ["Sat", "Sun"]
+	Weekdays []string
+	// App only counts keys typed into windows of this class
+	App string
+}
+
+type GoalProgress struct {
+	Name        string  `json:"name"`
+	Metric      string  `json:"metric"`
+	Period      string  `json:"period"`
+	PeriodStart string  `json:"periodStart"`
+	App         string  `json:"app,omitempty"`
+	Kind        string  `json:"kind"`
+	Target      int64   `json:"target"`
+	Value       int64   `json:"value"`
+	Progress    float64 `json:"progress"`
+	Met         bool    `json:"met"`
+}
+
+func (g *GoalConfig) metric() string {
+	if g.Metric == "" {
+		return GoalMetricKeys
+	}
+	return g.Metric
+}
+
+func (g *GoalConfig) period() string {
+	if g.Period == "" {
+		return BucketDay
+	}
+	return g.Period
+}
+
+func (g *GoalConfig) validate() error {
+	if g.Name == "" {
+		return fmt.Errorf("goal is missing a Name")
+	}
+
+	if (g.Min == nil) == (g.Max == nil) {
+		return fmt.Errorf("goal %q: set exactly one of Min or Max", g.Name)
+	}
+
+	if g.Min != nil && *g.Min <= 0 {
+		return fmt.Errorf("goal %q: Min must be positive", g.Name)
+	}
+
+	if g.Max != nil && *g.Max < 0 {
+		return fmt.Errorf("goal %q: Max can't be negative", g.Name)
+	}
+
+	switch g.metric() {
+	case GoalMetricKeys, GoalMetricActiveMinutes:
+	default:
+		return fmt.Errorf("goal %q: unknown Metric %q", g.Name, g.Metric)
+	}
+
+	switch g.period() {
+	case BucketDay, BucketWeek:
+	default:
+		return fmt.Errorf("goal %q: unknown Period %q", g.Name, g.Period)
+	}
+
+	if len(g.Weekdays) > 0 && g.period() != BucketDay {
+		return fmt.Errorf("goal %q: Weekdays only applies to daily goals", g.Name)
+	}
+
+	for _, day := range g.Weekdays {
+		if _, err := parseWeekday(day); err != nil {
+			return fmt.Errorf("goal %q: %v", g.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := day.String()
+		if strings.EqualFold(name, full) || strings.EqualFold(name, full[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", name)
+}
+
+// appliesOn returns true if the goal is tracked on the day starting at day
+func (g *GoalConfig) appliesOn(day time.Time) bool {
+	if len(g.Weekdays) == 0 {
+		return true
+	}
+
+	for _, name := range g.Weekdays {
+		if weekday, err := parseWeekday(name); err == nil && weekday == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// periodRange returns the period of the goal containing now
+func (g *GoalConfig) periodRange(now time.Time, newDayHour int) (time.Time, time.Time) {
+	start := LogicalDayStart(now, newDayHour)
+
+	if g.period() == BucketWeek {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	}
+
+	return start, start.AddDate(0, 0, 1)
+}
+
+// EvaluateGoals returns the progress of every goal for the period containing
+// now, without storing it. Daily goals that don't apply today are skipped.
+func (c keyCounts) EvaluateGoals(goals []GoalConfig, newDayHour int, now time.Time) ([]GoalProgress, error) {
+	out := make([]GoalProgress, 0, len(goals))
+
+	for _, goal := range goals {
+		if err := goal.validate(); err != nil {
+			return nil, err
+		}
+
+		start, end := goal.periodRange(now, newDayHour)
+		if !goal.appliesOn(start) {
+			continue
+		}
+
+		minutes, err := c.source.filteredCounts(start, end, time.Minute, keyFilter{App: goal.App})
+		if err != nil {
+			return nil, err
+		}
+
+		var value int64
+		if goal.metric() == GoalMetricActiveMinutes {
+			value = int64(len(minutes))
+		} else {
+			for _, count := range minutes {
+				value += count
+			}
+		}
+
+		progress := GoalProgress{
+			Name:        goal.Name,
+			Metric:      goal.metric(),
+			Period:      goal.period(),
+			PeriodStart: start.Format("2006-01-02"),
+			App:         goal.App,
+			Value:       value,
+		}
+
+		if goal.Max != nil {
+			progress.Kind = GoalKindMax
+			progress.Target = *goal.Max
+			progress.Met = value <= *goal.Max
+		} else {
+			progress.Kind = GoalKindMin
+			progress.Target = *goal.Min
+			progress.Met = value >= *goal.Min
+		}
+
+		progress.Progress = goalFraction(value, progress.Target)
+		out = append(out, progress)
+	}
+
+	return out, nil
+}
+
+// goalFraction returns value as a fraction of target. A target of 0 is
+// reached by any value.
+func goalFraction(value, target int64) float64 {
+	if target == 0 {
+		if value > 0 {
+			return 1
+		}
+		return 0
+	}
+	return float64(value) / float64(target)
+}
+
+// UpdateGoals evaluates every goal for the period containing now and stores
+// the result
+func (s *WatchStorage) UpdateGoals(goals []GoalConfig, newDayHour int, now time.Time) ([]GoalProgress, error) {
+	out, err := s.EvaluateGoals(goals, newDayHour, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, progress := range out {
+		_, err = s.db.Exec(`insert into goals(name, period_start, metric, kind, target, value, met, updated_at)
+			values(?, ?, ?, ?, ?, ?, ?, ?)
+			on conflict(name, period_start) do update set
+				metric = excluded.metric, kind = excluded.kind, target = excluded.target,
+				value = excluded.value, met = excluded.met, updated_at = excluded.updated_at`,
+			progress.Name, progress.PeriodStart, progress.Metric, progress.Kind,
+			progress.Target, progress.Value, progress.Met, now)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// RecordGoals stores the progress of goals every interval, in the background.
+// When a new day starts the final progress of the previous period is stored
+// too.
+func (s *WatchStorage) RecordGoals(goals []GoalConfig, newDayHour int, loc *time.Location, interval time.Duration) {
+	last := s.Now().In(loc)
+	if _, err := s.UpdateGoals(goals, newDayHour, last); err != nil {
+		log.Printf("Error recording goals: %v", err)
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			now := s.Now().In(loc)
+
+			times := []time.Time{now}
+			if !LogicalDayStart(now, newDayHour).Equal(LogicalDayStart(last, newDayHour)) {
+				times = []time.Time{last, now}
+			}
+
+			for _, t := range times {
+				if _, err := s.UpdateGoals(goals, newDayHour, t); err != nil {
+					log.Printf("Error recording goals: %v", err)
+				}
+			}
+
+			last = now
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package selfwatch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateGoals(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	rows := []struct {
+		createdAt string
+		keys      int
+		app       string
+	}{
+		{"2024-03-02 10:00:00", 3000, "Firefox"},
+		{"2024-03-02 10:00:30", 2000, "kitty"},
+		{"2024-03-02 11:15:00", 1000, "kitty"},
+		// the previous week
+		{"2024-02-25 10:00:00", 50000, "kitty"},
+	}
+
+	for _, row := range rows {
+		_, err := storage.db.Exec(`insert into keys(created_at, nrkeys, window_class) values(?, ?, ?)`,
+			row.createdAt, row.keys, row.app)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	goals := []GoalConfig{
+		{Name: "type", Min: goalTarget(5000)},
+		{Name: "terminal", Min: goalTarget(5000), App: "kitty"},
+		{Name: "focus", Metric: GoalMetricActiveMinutes, Min: goalTarget(2)},
+		{Name: "weekend", Max: goalTarget(20000), Weekdays: []string{"Sat", "Sunday"}},
+		{Name: "weekdays", Min: goalTarget(1), Weekdays: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}},
+		{Name: "week", Period: BucketWeek, Max: goalTarget(5000)},
+		{Name: "abstain", App: "Slack", Max: goalTarget(0)},
+	}
+
+	// Saturday
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	progress, err := storage.UpdateGoals(goals, 0, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []struct {
+		name  string
+		value int64
+		met   bool
+	}{
+		{"type", 6000, true},
+		{"terminal", 3000, false},
+		{"focus", 2, true},
+		{"weekend", 6000, true},
+		{"week", 6000, false},
+		{"abstain", 0, true},
+	}
+
+	if len(progress) != len(expected) {
+		t.Fatalf("Expected %d goals for the day, got %+v", len(expected), progress)
+	}
+
+	for i, e := range expected {
+		if progress[i].Name != e.name || progress[i].Value != e.value || progress[i].Met != e.met {
+			t.Fatalf("Expected %+v, got %+v", e, progress[i])
+		}
+	}
+
+	if progress[4].PeriodStart != "2024-02-26" {
+		t.Fatalf("Expected week to start on Monday, got %s", progress[4].PeriodStart)
+	}
+
+	var stored int
+	if err := storage.db.QueryRow(`select count(*) from goals`).Scan(&stored); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// evaluating again updates the stored progress instead of adding to it
+	if _, err := storage.UpdateGoals(goals, 0, now); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var restored int
+	if err := storage.db.QueryRow(`select count(*) from goals`).Scan(&restored); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if stored != len(expected) || restored != stored {
+		t.Fatalf("Expected %d stored goals, got %d then %d", len(expected), stored, restored)
+	}
+
+	// evaluating alone doesn't store anything
+	if _, err := storage.EvaluateGoals(goals, 0, now.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := storage.db.QueryRow(`select count(*) from goals`).Scan(&restored); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if restored != stored {
+		t.Fatalf("Expected evaluating goals not to store them, got %d stored goals", restored)
+	}
+
+	if _, err := storage.UpdateGoals([]GoalConfig{{Name: "bad", Min: goalTarget(1), Max: goalTarget(2)}}, 0, now); err == nil {
+		t.Fatal("Expected goal with both Min and Max to be rejected")
+	}
+
+	if _, err := storage.UpdateGoals([]GoalConfig{{Name: "bad", Min: goalTarget(0)}}, 0, now); err == nil {
+		t.Fatal("Expected goal with a Min of 0 to be rejected")
+	}
+}
+
+func goalTarget(n int64) *int64 {
+	return &n
+}
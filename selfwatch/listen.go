@@ -0,0 +1,168 @@
+package selfwatch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// prefix of listen addresses that refer to a unix domain socket path
+const unixAddrPrefix = "unix:"
+
+// file names of the generated self signed certificate, stored next to the
+// database
+const (
+	selfSignedCertName = "selfwatch-web.crt"
+	selfSignedKeyName  = "selfwatch-web.key"
+)
+
+// listen opens addr, either a TCP host:port or unix:/path/to/socket. Any
+// stale socket file is replaced, and the socket is created with socketMode
+// if given. The socket file is removed when the listener is closed.
+func listen(addr string, socketMode string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, unixAddrPrefix)
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+
+	path, err := expandHomePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if socketMode == "" {
+		return net.Listen("unix", path)
+	}
+
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %v", socketMode, err)
+	}
+
+	// the socket is created with the umask applied, so set it for the mode
+	// instead of changing the mode after anyone could connect
+	oldMask := syscall.Umask(int(^mode & 0777))
+	defer syscall.Umask(oldMask)
+
+	return net.Listen("unix", path)
+}
+
+// webTLSConfig loads the configured certificate, or a self signed one
+// generated on first use. Returns nil if TLS is disabled.
+func webTLSConfig(c *config, addr string) (*tls.Config, error) {
+	certFile, keyFile := c.WebCertFile, c.WebKeyFile
+
+	if certFile == "" {
+		if !c.WebTLS {
+			return nil, nil
+		}
+
+		var err error
+		certFile, keyFile, err = ensureSelfSignedCert(c, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// ensureSelfSignedCert returns the paths of the self signed certificate,
+// creating it if it doesn't exist yet
+func ensureSelfSignedCert(c *config, addr string) (string, string, error) {
+	dbPath, err := expandHomePath(c.DbName)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Dir(dbPath)
+	certFile := filepath.Join(dir, selfSignedCertName)
+	keyFile := filepath.Join(dir, selfSignedKeyName)
+
+	if _, err := os.Stat(certFile); err == nil {
+		return certFile, keyFile, nil
+	}
+
+	log.Printf("Generating self signed certificate %s", certFile)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"selfwatch"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "localhost" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
@@ -0,0 +1,445 @@
+package selfwatch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryRow struct {
+	id      int64
+	time    time.Time
+	keys    int64
+	app     string
+	title   string
+	project string
+}
+
+type memoryChunk struct {
+	SyncChunk
+	acked     bool
+	attempts  int
+	lastError string
+}
+
+// MemoryStorage is a Storage that keeps everything in memory, for tests and
+// for running without a database. Nothing is kept once it is discarded.
+type MemoryStorage struct {
+	keyCounts
+
+	mu    sync.Mutex
+	clock Clock
+
+	// rows are ordered by id
+	rows        []memoryRow
+	annotations []Annotation
+	goals       map[[2]string]GoalProgress
+
+	syncStatus *SyncStatus
+	outbox     []memoryChunk
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	storage := &MemoryStorage{
+		clock: SystemClock,
+		goals: make(map[[2]string]GoalProgress),
+	}
+	storage.keyCounts = keyCounts{storage}
+	return storage
+}
+
+// SetClock replaces the clock used for every time written and every period
+// counted up to now
+func (s *MemoryStorage) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// Now returns the current time according to the storage's clock
+func (s *MemoryStorage) Now() time.Time {
+	return s.clock.Now()
+}
+
+func (s *MemoryStorage) WriteKeys(keys int) error {
+	return s.WriteWindowKeys(keys, "", "", "")
+}
+
+// WriteWindowKeys stores keys typed into a window with the given class and
+// title, classified as project
+func (s *MemoryStorage) WriteWindowKeys(keys int, app, title, project string) error {
+	now := s.Now().UTC().Truncate(time.Second)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var id int64 = 1
+	if len(s.rows) > 0 {
+		id = s.rows[len(s.rows)-1].id + 1
+	}
+
+	s.rows = append(s.rows, memoryRow{
+		id:      id,
+		time:    now,
+		keys:    int64(keys),
+		app:     app,
+		title:   title,
+		project: project,
+	})
+	return nil
+}
+
+// InsertKeyRows stores rows received from another selfwatch instance,
+// keeping their original ids. Rows that already exist are skipped.
+func (s *MemoryStorage) InsertKeyRows(rows []KeyRow) error {
+	parsed := make([]memoryRow, 0, len(rows))
+	for _, row := range rows {
+		t, err := time.Parse("2006-01-02 15:04:05", row.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", row.Id, err)
+		}
+		parsed = append(parsed, memoryRow{id: row.Id, time: t, keys: row.NrKeys})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range parsed {
+		i := s.rowIndex(row.id)
+		if i < len(s.rows) && s.rows[i].id == row.id {
+			continue
+		}
+
+		s.rows = append(s.rows, memoryRow{})
+		copy(s.rows[i+1:], s.rows[i:])
+		s.rows[i] = row
+	}
+
+	return nil
+}
+
+// rowIndex returns the index of the first row with an id of at least id
+func (s *MemoryStorage) rowIndex(id int64) int {
+	return sort.Search(len(s.rows), func(i int) bool {
+		return s.rows[i].id >= id
+	})
+}
+
+func (s *MemoryStorage) KeyCountsAfterId(id int64) ([]KeyRow, error) {
+	return s.KeyCountsInIdRange(id+1, math.MaxInt64)
+}
+
+func (s *MemoryStorage) KeyCountsInIdRange(first, last int64) ([]KeyRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []KeyRow
+	for _, row := range s.rows[s.rowIndex(first):] {
+		if row.id > last {
+			break
+		}
+		out = append(out, KeyRow{
+			Id:        row.id,
+			CreatedAt: row.time.Format("2006-01-02 15:04:05"),
+			NrKeys:    row.keys,
+		})
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStorage) GetLastKeyPress() (*time.Time, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.rows) == 0 {
+		return nil, 0, nil
+	}
+
+	last := s.rows[len(s.rows)-1]
+	return &last.time, last.id, nil
+}
+
+func (s *MemoryStorage) TotalKeys() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, row := range s.rows {
+		total += row.keys
+	}
+	return total, nil
+}
+
+func (s *MemoryStorage) filteredCounts(from, to time.Time, grain time.Duration, filter keyFilter) (map[time.Time]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[time.Time]int64)
+	for _, row := range s.rows {
+		if row.time.Before(from) || !row.time.Before(to) {
+			continue
+		}
+		if filter.App != "" && row.app != filter.App {
+			continue
+		}
+		out[row.time.Truncate(grain)] += row.keys
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStorage) projectMinuteCounts(from, to time.Time) (map[time.Time]map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[time.Time]map[string]int64)
+	for _, row := range s.rows {
+		if row.time.Before(from) || !row.time.Before(to) {
+			continue
+		}
+
+		minute := row.time.Truncate(time.Minute)
+		if out[minute] == nil {
+			out[minute] = make(map[string]int64)
+		}
+		out[minute][row.project] += row.keys
+	}
+
+	return out, nil
+}
+
+// UpdateGoals evaluates every goal for the period containing now and stores
+// the result
+func (s *MemoryStorage) UpdateGoals(goals []GoalConfig, newDayHour int, now time.Time) ([]GoalProgress, error) {
+	out, err := s.EvaluateGoals(goals, newDayHour, now)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, progress := range out {
+		s.goals[[2]string{progress.Name, progress.PeriodStart}] = progress
+	}
+
+	return out, nil
+}
+
+func (s *MemoryStorage) AddAnnotation(annotation *Annotation) error {
+	if !annotation.Start.Before(annotation.End) {
+		return fmt.Errorf("annotation ends before it starts")
+	}
+
+	if annotation.Tags == nil {
+		annotation.Tags = make([]string, 0)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	annotation.Id = 1
+	if len(s.annotations) > 0 {
+		annotation.Id = s.annotations[len(s.annotations)-1].Id + 1
+	}
+
+	stored := *annotation
+	stored.Tags = append([]string{}, annotation.Tags...)
+	s.annotations = append(s.annotations, stored)
+	return nil
+}
+
+// Annotations returns the annotations overlapping [from, to), in loc
+func (s *MemoryStorage) Annotations(from, to time.Time, loc *time.Location) ([]Annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Annotation, 0)
+	for _, annotation := range s.annotations {
+		if !annotation.Start.Before(to) || !annotation.End.After(from) {
+			continue
+		}
+
+		annotation.Start = annotation.Start.In(loc)
+		annotation.End = annotation.End.In(loc)
+		annotation.Tags = append([]string{}, annotation.Tags...)
+		out = append(out, annotation)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Start.Before(out[j].Start)
+	})
+
+	return out, nil
+}
+
+// DeleteAnnotation removes an annotation, returning false if it didn't exist
+func (s *MemoryStorage) DeleteAnnotation(id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, annotation := range s.annotations {
+		if annotation.Id == id {
+			s.annotations = append(s.annotations[:i], s.annotations[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// EnqueueSyncRows adds chunks to the outbox for every row after the last
+// queued one, up to chunkSize rows each. If the outbox is empty, rows up to
+// and including remoteMaxId are considered already acknowledged. If the
+// remote has lost rows it acknowledged the outbox is rebuilt.
+func (s *MemoryStorage) EnqueueSyncRows(url string, remoteMaxId int64, chunkSize int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the outbox is cleared when it was built for a different remote
+	if s.syncStatus == nil || s.syncStatus.RemoteUrl != url {
+		s.syncStatus = &SyncStatus{RemoteUrl: url}
+		s.outbox = nil
+	}
+
+	for _, chunk := range s.outbox {
+		if chunk.acked && chunk.LastRowId > remoteMaxId {
+			s.outbox = nil
+			break
+		}
+	}
+
+	if len(s.outbox) == 0 && remoteMaxId > 0 {
+		s.addChunk(0, remoteMaxId).acked = true
+	}
+
+	var lastQueued int64
+	if len(s.outbox) > 0 {
+		lastQueued = s.outbox[len(s.outbox)-1].LastRowId
+	}
+
+	var ids []int64
+	for _, row := range s.rows[s.rowIndex(lastQueued+1):] {
+		ids = append(ids, row.id)
+	}
+
+	for left := 0; left < len(ids); left += chunkSize {
+		right := min(left+chunkSize, len(ids))
+		s.addChunk(ids[left], ids[right-1])
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) addChunk(first, last int64) *memoryChunk {
+	var id int64 = 1
+	if len(s.outbox) > 0 {
+		id = s.outbox[len(s.outbox)-1].Id + 1
+	}
+
+	s.outbox = append(s.outbox, memoryChunk{
+		SyncChunk: SyncChunk{Id: id, FirstRowId: first, LastRowId: last},
+	})
+	return &s.outbox[len(s.outbox)-1]
+}
+
+func (s *MemoryStorage) PendingSyncChunks() ([]SyncChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []SyncChunk
+	for _, chunk := range s.outbox {
+		if !chunk.acked {
+			out = append(out, chunk.SyncChunk)
+		}
+	}
+
+	return out, nil
+}
+
+// AckSyncChunk marks a chunk as received by the remote and drops older
+// acknowledged chunks, which are no longer needed
+func (s *MemoryStorage) AckSyncChunk(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.outbox[:0]
+	for _, chunk := range s.outbox {
+		if chunk.Id == id {
+			chunk.acked = true
+		}
+		if chunk.acked && chunk.Id < id {
+			continue
+		}
+		kept = append(kept, chunk)
+	}
+	s.outbox = kept
+
+	return nil
+}
+
+func (s *MemoryStorage) FailSyncChunk(id int64, syncErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.outbox {
+		if s.outbox[i].Id == id {
+			s.outbox[i].attempts += 1
+			s.outbox[i].lastError = syncErr.Error()
+		}
+	}
+
+	return nil
+}
+
+// RecordSyncAttempt stores the outcome of a sync, syncErr is nil on success
+func (s *MemoryStorage) RecordSyncAttempt(syncErr error) error {
+	now := s.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.syncStatus == nil {
+		s.syncStatus = &SyncStatus{}
+	}
+
+	s.syncStatus.LastAttempt = &now
+	if syncErr != nil {
+		s.syncStatus.LastError = syncErr.Error()
+		return nil
+	}
+
+	s.syncStatus.LastSuccess = &now
+	s.syncStatus.LastError = ""
+	return nil
+}
+
+// SyncStatus summarizes sync progress. Returns nil if sync has never run.
+func (s *MemoryStorage) SyncStatus() (*SyncStatus, error) {
+	now := s.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.syncStatus == nil {
+		return nil, nil
+	}
+
+	status := *s.syncStatus
+	for _, chunk := range s.outbox {
+		if chunk.acked {
+			status.AckedRowId = max(status.AckedRowId, chunk.LastRowId)
+		} else {
+			status.PendingChunks += 1
+		}
+	}
+
+	pending := s.rows[s.rowIndex(status.AckedRowId+1):]
+	status.PendingRows = int64(len(pending))
+	if len(pending) > 0 {
+		status.LagSeconds = now.Sub(pending[0].time).Seconds()
+	}
+
+	return &status, nil
+}
@@ -0,0 +1,207 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorageCounts(t *testing.T) {
+	sqlite := newCountsFixture(t)
+
+	memory := NewMemoryStorage()
+	memory.SetClock(writeCountsFixture(t, memory))
+
+	now := countsFixtureNow
+	loc := now.Location()
+
+	// every aggregation gives the same results as the SQLite backend
+	queries := map[string]func(Storage) (interface{}, error){
+		"DailyCounts": func(s Storage) (interface{}, error) {
+			return s.DailyCounts(7, 4, now)
+		},
+		"HourlyCounts": func(s Storage) (interface{}, error) {
+			return s.HourlyCounts(24, 0, now)
+		},
+		"HourlyCountsForDate": func(s Storage) (interface{}, error) {
+			return s.HourlyCountsForDate("2024-03-10", loc)
+		},
+		"YearlyCounts": func(s Storage) (interface{}, error) {
+			return s.YearlyCounts(2024, 4, loc)
+		},
+		"RangeCounts": func(s Storage) (interface{}, error) {
+			return s.RangeCounts(time.Unix(0, 0), now, BucketWeek, loc, 4)
+		},
+		"WeeklyHourlyGrid": func(s Storage) (interface{}, error) {
+			return s.WeeklyHourlyGrid(now)
+		},
+		"Stats": func(s Storage) (interface{}, error) {
+			return s.Stats(4, 4, now)
+		},
+		"TotalCount": func(s Storage) (interface{}, error) {
+			return s.TotalCount(LogicalDayStart(now, 4), now)
+		},
+		"ProjectCounts": func(s Storage) (interface{}, error) {
+			return s.ProjectCounts(time.Unix(0, 0), now)
+		},
+		"UpdateGoals": func(s Storage) (interface{}, error) {
+			return s.UpdateGoals([]GoalConfig{{Name: "typing", Min: goalTarget(10)}}, 4, now)
+		},
+		"TotalKeys": func(s Storage) (interface{}, error) {
+			return s.TotalKeys()
+		},
+		"KeyCountsAfterId": func(s Storage) (interface{}, error) {
+			return s.KeyCountsAfterId(7)
+		},
+	}
+
+	for name, query := range queries {
+		expected, err := query(sqlite)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		got, err := query(memory)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%s: expected %+v, got %+v", name, expected, got)
+		}
+	}
+}
+
+func TestMemoryStorageAnnotations(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	later := &Annotation{
+		Start: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC),
+	}
+	earlier := &Annotation{
+		Start: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC),
+		Tags:  []string{"travel"},
+	}
+
+	for _, annotation := range []*Annotation{later, earlier} {
+		if err := storage.AddAnnotation(annotation); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := storage.AddAnnotation(&Annotation{Start: later.End, End: later.Start}); err == nil {
+		t.Fatal("Expected an error for an annotation ending before it starts")
+	}
+
+	annotations, err := storage.Annotations(time.Date(2024, 3, 2, 6, 0, 0, 0, time.UTC), time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), time.UTC)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(annotations) != 2 || annotations[0].Id != earlier.Id || annotations[1].Id != later.Id {
+		t.Fatalf("Unexpected annotations %+v", annotations)
+	}
+
+	if deleted, _ := storage.DeleteAnnotation(earlier.Id); !deleted {
+		t.Fatal("Expected the annotation to be deleted")
+	}
+
+	if deleted, _ := storage.DeleteAnnotation(earlier.Id); deleted {
+		t.Fatal("Expected deleting a missing annotation to return false")
+	}
+}
+
+func TestMemoryStorageRemoteSync(t *testing.T) {
+	local := NewMemoryStorage()
+	remote := newTestStorage(t, testRemoteDbName)
+	defer removeDb(testRemoteDbName)
+
+	for _, keys := range []int{5, 2, 6} {
+		if err := local.WriteKeys(keys); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	server := httptest.NewServer(&SyncReceiver{Storage: remote})
+	defer server.Close()
+
+	sync := RemoteSync{Url: server.URL, Storage: local}
+	if err := sync.FlushKeys(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := local.WriteKeys(1); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := sync.FlushKeys(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	total, err := remote.TotalKeys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total != 14 {
+		t.Fatalf("Expected the remote to have 14 keys, got %d", total)
+	}
+
+	status, err := local.SyncStatus()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if status.AckedRowId != 4 || status.PendingRows != 0 || status.PendingChunks != 0 || status.LastSuccess == nil {
+		t.Fatalf("Unexpected sync status %+v", status)
+	}
+}
+
+func TestWebMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.SetClock(ClockFunc(func() time.Time {
+		return time.Date(2024, 3, 13, 12, 0, 0, 0, time.UTC)
+	}))
+
+	if err := storage.WriteKeys(42); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cfg := defaultConfig
+	handler, err := NewWebServer(storage, &cfg, "", "test", "today").Handler()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/daily?tz=UTC")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var counts []DailyCount
+	json.NewDecoder(res.Body).Decode(&counts)
+	res.Body.Close()
+
+	if !reflect.DeepEqual(counts, []DailyCount{{"2024-03-13", 42}}) {
+		t.Fatalf("Unexpected daily counts %v", counts)
+	}
+
+	res, err = http.Post(server.URL+"/api/annotations", "application/json",
+		strings.NewReader(`{"date": "2024-03-13", "note": "launch"}`))
+	expectStatus(t, res, err, http.StatusCreated)
+
+	annotations, err := storage.Annotations(time.Unix(0, 0), storage.Now().AddDate(1, 0, 0), time.UTC)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(annotations) != 1 || annotations[0].Note != "launch" {
+		t.Fatalf("Unexpected annotations %+v", annotations)
+	}
+}
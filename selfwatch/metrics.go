@@ -0,0 +1,136 @@
+package selfwatch
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RecorderMetrics counts activity seen by the recorder daemon, for export in
+// the Prometheus text format
+type RecorderMetrics struct {
+	mu sync.Mutex
+
+	started     time.Time
+	keys        int64
+	clicks      int64
+	flushes     int64
+	writeErrors int64
+	lastFlush   time.Time
+	session     *sessionTracker
+
+	storage *WatchStorage
+}
+
+func NewRecorderMetrics(sessionIdle time.Duration) *RecorderMetrics {
+	return &RecorderMetrics{
+		started: time.Now(),
+		session: newSessionTracker(sessionIdle),
+	}
+}
+
+// Bind counts key presses and clicks from recorder and writes to storage.
+// It wraps the recorder's existing callbacks, so it must be called after
+// WatchStorage.BindRecorder.
+func (m *RecorderMetrics) Bind(recorder *Recorder, storage *WatchStorage) {
+	m.storage = storage
+
+	keyRelease := recorder.KeyRelease
+	recorder.KeyRelease = func(event Event) {
+		m.mu.Lock()
+		m.keys += 1
+		m.session.activity(time.Now())
+		m.mu.Unlock()
+
+		if keyRelease != nil {
+			keyRelease(event)
+		}
+	}
+
+	buttonRelease := recorder.ButtonRelease
+	recorder.ButtonRelease = func(event Event) {
+		m.mu.Lock()
+		m.clicks += 1
+		m.session.activity(time.Now())
+		m.mu.Unlock()
+
+		if buttonRelease != nil {
+			buttonRelease(event)
+		}
+	}
+
+	storage.OnFlush(func(flush FlushEvent) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if flush.Err != nil {
+			m.writeErrors += 1
+		} else {
+			m.flushes += 1
+			m.lastFlush = flush.Time
+		}
+	})
+}
+
+func (m *RecorderMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+
+	m.mu.Lock()
+	now := time.Now()
+	writeMetric(w, "selfwatch_recorder_start_time_seconds", "gauge", "Time the recorder started", float64(m.started.Unix()))
+	writeMetric(w, "selfwatch_recorded_keys_total", "counter", "Key presses seen since the recorder started", float64(m.keys))
+	writeMetric(w, "selfwatch_recorded_clicks_total", "counter", "Mouse clicks seen since the recorder started", float64(m.clicks))
+	writeMetric(w, "selfwatch_flushes_total", "counter", "Successful writes of buffered key presses", float64(m.flushes))
+	writeMetric(w, "selfwatch_write_errors_total", "counter", "Failed writes of buffered key presses", float64(m.writeErrors))
+	if !m.lastFlush.IsZero() {
+		writeMetric(w, "selfwatch_last_flush_timestamp_seconds", "gauge", "Time of the last successful write", float64(m.lastFlush.Unix()))
+	}
+	writeMetric(w, "selfwatch_session_seconds", "gauge", "Length of the current activity session, 0 when idle", m.session.length(now).Seconds())
+	m.mu.Unlock()
+
+	if m.storage != nil {
+		writeStorageMetrics(w, m.storage)
+	}
+}
+
+// ListenAndServe serves the metrics at /metrics on addr
+func (m *RecorderMetrics) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	log.Printf("Serving metrics at http://%s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// writeStorageMetrics writes metrics read from the database, which are
+// available to both the recorder and the web server
+func writeStorageMetrics(w io.Writer, storage Storage) {
+	totalKeys, err := storage.TotalKeys()
+	if err != nil {
+		log.Printf("Error reading metrics: %v", err)
+		return
+	}
+	writeMetric(w, "selfwatch_keys_total", "counter", "Key presses stored in the database", float64(totalKeys))
+
+	lastPress, _, err := storage.GetLastKeyPress()
+	if err == nil && lastPress != nil {
+		writeMetric(w, "selfwatch_last_write_timestamp_seconds", "gauge", "Time of the most recently stored row", float64(lastPress.Unix()))
+	}
+
+	status, err := storage.SyncStatus()
+	if err == nil && status != nil {
+		writeMetric(w, "selfwatch_sync_lag_seconds", "gauge", "Age of the oldest row not yet acknowledged by the remote", status.LagSeconds)
+		writeMetric(w, "selfwatch_sync_pending_rows", "gauge", "Rows not yet acknowledged by the remote", float64(status.PendingRows))
+		if status.LastSuccess != nil {
+			writeMetric(w, "selfwatch_sync_last_success_timestamp_seconds", "gauge", "Time of the last successful sync", float64(status.LastSuccess.Unix()))
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package selfwatch
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorderMetrics(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	recorder := &Recorder{}
+	storage.BindRecorder(recorder, 0)
+
+	metrics := NewRecorderMetrics(time.Minute)
+	metrics.Bind(recorder, storage)
+
+	for i := 0; i < 3; i++ {
+		recorder.KeyRelease(Event{Window: 1})
+	}
+	recorder.ButtonRelease(Event{Window: 1})
+
+	// writes are stored in the background
+	if err := storage.batch.Flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res := httptest.NewRecorder()
+	metrics.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	body := res.Body.String()
+
+	for _, expected := range []string{
+		"selfwatch_recorded_keys_total 3\n",
+		"selfwatch_recorded_clicks_total 1\n",
+		"selfwatch_flushes_total 1\n",
+		"selfwatch_write_errors_total 0\n",
+		"selfwatch_keys_total 3\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
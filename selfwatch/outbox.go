@@ -0,0 +1,289 @@
+package selfwatch
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Rows queued for sync are tracked in chunks so an interrupted sync resumes
+// from the first unacknowledged chunk. sync_status holds a single row
+// describing the last attempt.
+var syncOutboxSchema = `
+CREATE TABLE IF NOT EXISTS sync_outbox (
+	id INTEGER NOT NULL,
+	created_at DATETIME,
+	first_row_id INTEGER NOT NULL,
+	last_row_id INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	acked_at DATETIME,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS ix_sync_outbox_acked_at ON sync_outbox (acked_at);
+CREATE TABLE IF NOT EXISTS sync_status (
+	id INTEGER NOT NULL,
+	remote_url TEXT,
+	last_attempt_at DATETIME,
+	last_success_at DATETIME,
+	last_error TEXT,
+	PRIMARY KEY (id)
+);
+`
+
+// SyncChunk is a range of rows sent to the remote in one request
+type SyncChunk struct {
+	Id         int64
+	FirstRowId int64
+	LastRowId  int64
+}
+
+type SyncStatus struct {
+	RemoteUrl     string     `json:"remote_url"`
+	LastAttempt   *time.Time `json:"last_attempt"`
+	LastSuccess   *time.Time `json:"last_success"`
+	LastError     string     `json:"last_error"`
+	AckedRowId    int64      `json:"acked_row_id"`
+	PendingRows   int64      `json:"pending_rows"`
+	PendingChunks int64      `json:"pending_chunks"`
+	// LagSeconds is the age of the oldest row the remote doesn't have yet
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// resetOutboxForRemote clears the outbox if it was built for a different
+// remote. Returns true if the outbox is empty.
+func (s *WatchStorage) resetOutboxForRemote(url string) (bool, error) {
+	var current sql.NullString
+	err := s.db.QueryRow(`select remote_url from sync_status where id = 1`).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	if current.String != url {
+		if _, err := s.db.Exec(`delete from sync_outbox`); err != nil {
+			return false, err
+		}
+
+		_, err = s.db.Exec(`insert into sync_status(id, remote_url) values(1, ?)
+			on conflict(id) do update set remote_url = excluded.remote_url,
+				last_attempt_at = null, last_success_at = null, last_error = null`, url)
+		return true, err
+	}
+
+	var count int64
+	if err := s.db.QueryRow(`select count(*) from sync_outbox`).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count == 0, nil
+}
+
+// EnqueueSyncRows adds chunks to the outbox for every row after the last
+// queued one, up to chunkSize rows each. If the outbox is empty, rows up to
+// and including remoteMaxId are considered already acknowledged. If the
+// remote has lost rows it acknowledged, eg. it was restored from a backup,
+// the outbox is rebuilt to send everything after remoteMaxId again.
+func (s *WatchStorage) EnqueueSyncRows(url string, remoteMaxId int64, chunkSize int) error {
+	empty, err := s.resetOutboxForRemote(url)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var acked int64
+	err = tx.QueryRow(`select coalesce(max(last_row_id), 0) from sync_outbox where acked_at is not null`).Scan(&acked)
+	if err != nil {
+		return err
+	}
+
+	if remoteMaxId < acked {
+		log.Printf("Remote only has rows up to %d of %d acknowledged, sending the rest again", remoteMaxId, acked)
+		if _, err = tx.Exec(`delete from sync_outbox`); err != nil {
+			return err
+		}
+		empty = true
+	}
+
+	if empty && remoteMaxId > 0 {
+		_, err = tx.Exec(`insert into sync_outbox(created_at, first_row_id, last_row_id, acked_at)
+			values(?, 0, ?, ?)`, s.Now(), remoteMaxId, s.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	var lastQueued int64
+	err = tx.QueryRow(`select coalesce(max(last_row_id), 0) from sync_outbox`).Scan(&lastQueued)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`select id from keys where id > ? order by id asc`, lastQueued)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for left := 0; left < len(ids); left += chunkSize {
+		right := min(left+chunkSize, len(ids))
+		_, err = tx.Exec(`insert into sync_outbox(created_at, first_row_id, last_row_id) values(?, ?, ?)`,
+			s.Now(), ids[left], ids[right-1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *WatchStorage) PendingSyncChunks() ([]SyncChunk, error) {
+	rows, err := s.db.Query(`select id, first_row_id, last_row_id
+		from sync_outbox where acked_at is null order by id asc`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var out []SyncChunk
+	for rows.Next() {
+		var chunk SyncChunk
+		if err = rows.Scan(&chunk.Id, &chunk.FirstRowId, &chunk.LastRowId); err != nil {
+			return nil, err
+		}
+		out = append(out, chunk)
+	}
+
+	return out, nil
+}
+
+func (s *WatchStorage) KeyCountsInIdRange(first, last int64) ([]KeyRow, error) {
+	rows, err := s.db.Query(`select
+			id,
+			strftime('%Y-%m-%d %H:%M:%S', created_at),
+			nrkeys
+		from keys where id >= ? and id <= ?
+		order by id asc;`, first, last)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var out []KeyRow
+
+	for rows.Next() {
+		var row KeyRow
+		if err = rows.Scan(&row.Id, &row.CreatedAt, &row.NrKeys); err != nil {
+			return nil, err
+		}
+		out = append(out, row)
+	}
+
+	return out, nil
+}
+
+// AckSyncChunk marks a chunk as received by the remote and drops older
+// acknowledged chunks, which are no longer needed
+func (s *WatchStorage) AckSyncChunk(id int64) error {
+	_, err := s.db.Exec(`update sync_outbox set acked_at = ? where id = ?`, s.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`delete from sync_outbox where acked_at is not null and id < ?`, id)
+	return err
+}
+
+func (s *WatchStorage) FailSyncChunk(id int64, syncErr error) error {
+	_, err := s.db.Exec(`update sync_outbox set attempts = attempts + 1, last_error = ? where id = ?`,
+		syncErr.Error(), id)
+	return err
+}
+
+// RecordSyncAttempt stores the outcome of a sync, syncErr is nil on success
+func (s *WatchStorage) RecordSyncAttempt(syncErr error) error {
+	_, err := s.db.Exec(`insert into sync_status(id) values(1) on conflict(id) do nothing`)
+	if err != nil {
+		return err
+	}
+
+	now := s.Now()
+	if syncErr != nil {
+		_, err := s.db.Exec(`update sync_status set last_attempt_at = ?, last_error = ? where id = 1`,
+			now, syncErr.Error())
+		return err
+	}
+
+	_, err = s.db.Exec(`update sync_status set last_attempt_at = ?, last_success_at = ?, last_error = null
+		where id = 1`, now, now)
+	return err
+}
+
+// SyncStatus summarizes sync progress. Returns nil if sync has never run.
+func (s *WatchStorage) SyncStatus() (*SyncStatus, error) {
+	var status SyncStatus
+	var remoteUrl, lastError sql.NullString
+	var lastAttempt, lastSuccess sql.NullTime
+
+	err := s.db.QueryRow(`select remote_url, last_attempt_at, last_success_at, last_error
+		from sync_status where id = 1`).Scan(&remoteUrl, &lastAttempt, &lastSuccess, &lastError)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	status.RemoteUrl = remoteUrl.String
+	status.LastError = lastError.String
+	if lastAttempt.Valid {
+		status.LastAttempt = &lastAttempt.Time
+	}
+	if lastSuccess.Valid {
+		status.LastSuccess = &lastSuccess.Time
+	}
+
+	err = s.db.QueryRow(`select
+			coalesce((select max(last_row_id) from sync_outbox where acked_at is not null), 0),
+			(select count(*) from sync_outbox where acked_at is null)
+	`).Scan(&status.AckedRowId, &status.PendingChunks)
+	if err != nil {
+		return nil, err
+	}
+
+	var oldest sql.NullString
+	err = s.db.QueryRow(`select count(*),
+			(select strftime('%Y-%m-%d %H:%M:%S', created_at) from keys where id > ? order by id asc limit 1)
+		from keys where id > ?`, status.AckedRowId, status.AckedRowId).Scan(&status.PendingRows, &oldest)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldest.Valid {
+		if t, err := time.Parse("2006-01-02 15:04:05", oldest.String); err == nil {
+			status.LagSeconds = s.Now().Sub(t).Seconds()
+		}
+	}
+
+	return &status, nil
+}
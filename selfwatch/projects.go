@@ -0,0 +1,280 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// ProjectRule assigns keys to a project when the window they were typed into
+// matches. Class and Title are regular expressions, an empty one matches any
+// window. Project can refer to groups captured by Title, or by Class if
+// Title is empty, eg. "$1".
+type ProjectRule struct {
+	Project string
+	Class   string
+	Title   string
+}
+
+type projectRule struct {
+	project string
+	class   *regexp.Regexp
+	title   *regexp.Regexp
+}
+
+// ProjectRules classifies windows by the first rule they match
+type ProjectRules struct {
+	rules []projectRule
+}
+
+func NewProjectRules(rules []ProjectRule) (*ProjectRules, error) {
+	out := &ProjectRules{}
+
+	for i, rule := range rules {
+		if rule.Project == "" {
+			return nil, fmt.Errorf("project rule %d: missing Project", i+1)
+		}
+
+		compiled := projectRule{project: rule.Project}
+
+		var err error
+		if rule.Class != "" {
+			if compiled.class, err = regexp.Compile(rule.Class); err != nil {
+				return nil, fmt.Errorf("project rule %d: invalid Class: %w", i+1, err)
+			}
+		}
+
+		if rule.Title != "" {
+			if compiled.title, err = regexp.Compile(rule.Title); err != nil {
+				return nil, fmt.Errorf("project rule %d: invalid Title: %w", i+1, err)
+			}
+		}
+
+		out.rules = append(out.rules, compiled)
+	}
+
+	return out, nil
+}
+
+// Classify returns the project for a window, or an empty string if no rule
+// matches
+func (p *ProjectRules) Classify(class, title string) string {
+	if p == nil {
+		return ""
+	}
+
+	for _, rule := range p.rules {
+		var classMatch, titleMatch []int
+
+		if rule.class != nil {
+			if classMatch = rule.class.FindStringSubmatchIndex(class); classMatch == nil {
+				continue
+			}
+		}
+
+		if rule.title != nil {
+			if titleMatch = rule.title.FindStringSubmatchIndex(title); titleMatch == nil {
+				continue
+			}
+			return string(rule.title.ExpandString(nil, rule.project, title, titleMatch))
+		}
+
+		if rule.class != nil {
+			return string(rule.class.ExpandString(nil, rule.project, class, classMatch))
+		}
+
+		return rule.project
+	}
+
+	return ""
+}
+
+// SetProjectRules sets the rules used to classify keys written by
+// BindRecorder
+func (s *WatchStorage) SetProjectRules(rules *ProjectRules) {
+	s.projects = rules
+}
+
+// Reclassify applies rules to every stored row, returning how many rows
+// changed project. Rows recorded before window titles were stored are
+// classified by their window class alone.
+func (s *WatchStorage) Reclassify(rules *ProjectRules) (int64, error) {
+	rows, err := s.db.Query(`
+		select distinct coalesce(window_class, ''), coalesce(window_title, '')
+		from keys;
+	`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	type window struct{ class, title string }
+	var windows []window
+
+	for rows.Next() {
+		var w window
+		if err := rows.Scan(&w.class, &w.title); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		windows = append(windows, w)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	// the project of every window is stored in a temporary table so every
+	// row is updated in a single pass over keys
+	_, err = tx.Exec(`
+		drop table if exists temp.window_projects;
+		create temp table window_projects (
+			window_class TEXT NOT NULL,
+			window_title TEXT NOT NULL,
+			project TEXT NOT NULL,
+			PRIMARY KEY (window_class, window_title)
+		);
+	`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`insert into window_projects(window_class, window_title, project) values(?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+
+	defer stmt.Close()
+
+	for _, w := range windows {
+		if _, err := stmt.Exec(w.class, w.title, rules.Classify(w.class, w.title)); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.Exec(`
+		update keys set project = nullif(window_projects.project, '')
+		from window_projects
+		where coalesce(keys.window_class, '') = window_projects.window_class
+			and coalesce(keys.window_title, '') = window_projects.window_title
+			and coalesce(keys.project, '') != window_projects.project;
+	`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`drop table temp.window_projects`); err != nil {
+		return 0, err
+	}
+
+	return changed, tx.Commit()
+}
+
+type ProjectCount struct {
+	Project string `json:"project"`
+	Count   int64  `json:"count"`
+	// Minutes is how many minutes had keys typed into the project
+	Minutes int64 `json:"minutes"`
+}
+
+// ProjectCounts sums keys in [from, to) by project, most keys first. Keys
+// that weren't classified are counted under an empty project.
+func (c keyCounts) ProjectCounts(from, to time.Time) ([]ProjectCount, error) {
+	minutes, err := c.source.projectMinuteCounts(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]*ProjectCount)
+	for _, projects := range minutes {
+		for project, count := range projects {
+			sum := sums[project]
+			if sum == nil {
+				sum = &ProjectCount{Project: project}
+				sums[project] = sum
+			}
+			sum.Count += count
+			sum.Minutes += 1
+		}
+	}
+
+	out := make([]ProjectCount, 0, len(sums))
+	for _, sum := range sums {
+		out = append(out, *sum)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Project < out[j].Project
+	})
+
+	return out, nil
+}
+
+// handleProjects returns keys by project for the from and to parameters,
+// defaulting to the last 30 days
+func (ws *WebServer) handleProjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	loc, err := ws.location(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to := ws.Storage.Now().In(loc)
+	if toParam := query.Get("to"); toParam != "" {
+		parsed, isDate, err := parseRangeTime(toParam, loc, ws.Config.NewDayHour)
+		if err != nil {
+			http.Error(w, "Invalid to, expected YYYY-MM-DD or RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		if isDate {
+			parsed = parsed.AddDate(0, 0, 1)
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -30)
+	if fromParam := query.Get("from"); fromParam != "" {
+		parsed, _, err := parseRangeTime(fromParam, loc, ws.Config.NewDayHour)
+		if err != nil {
+			http.Error(w, "Invalid from, expected YYYY-MM-DD or RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	counts, err := ws.Storage.ProjectCounts(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
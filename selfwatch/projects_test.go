@@ -0,0 +1,144 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var testProjectRules = []ProjectRule{
+	{Project: "$1", Title: `~/code/([\w-]+)`},
+	{Project: "selfwatch", Class: "^Firefox$", Title: "selfwatch"},
+	{Project: "chat", Class: "^(Slack|discord)$"},
+}
+
+func TestClassifyProjects(t *testing.T) {
+	rules, err := NewProjectRules(testProjectRules)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	windows := []struct{ class, title, project string }{
+		{"kitty", "nvim ~/code/moonscript/init.moon", "moonscript"},
+		{"Code", "storage.go - ~/code/selfwatch", "selfwatch"},
+		{"Firefox", "leafo/selfwatch: Pull requests", "selfwatch"},
+		{"Chromium", "leafo/selfwatch: Pull requests", ""},
+		{"Slack", "general", "chat"},
+		{"", "", ""},
+	}
+
+	for _, w := range windows {
+		if project := rules.Classify(w.class, w.title); project != w.project {
+			t.Fatalf("Expected %q for %s %q, got %q", w.project, w.class, w.title, project)
+		}
+	}
+
+	var none *ProjectRules
+	if project := none.Classify("Slack", ""); project != "" {
+		t.Fatalf("Expected no project without rules, got %q", project)
+	}
+
+	if _, err := NewProjectRules([]ProjectRule{{Project: "broken", Title: "("}}); err == nil {
+		t.Fatal("Expected an error for an invalid regular expression")
+	}
+
+	if _, err := NewProjectRules([]ProjectRule{{Class: "Slack"}}); err == nil {
+		t.Fatal("Expected an error for a rule without a project")
+	}
+}
+
+func TestReclassify(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	now := time.Now().Truncate(time.Minute)
+	rows := []struct {
+		minutesAgo int
+		keys       int
+		class      string
+		title      string
+	}{
+		{10, 100, "kitty", "nvim ~/code/moonscript/init.moon"},
+		{10, 50, "kitty", "nvim ~/code/moonscript/parse.moon"},
+		{9, 200, "Code", "storage.go - ~/code/selfwatch"},
+		{8, 30, "Slack", ""},
+		{7, 5, "", ""},
+	}
+
+	for _, row := range rows {
+		_, err := storage.db.Exec(`insert into keys(created_at, nrkeys, window_class, window_title) values(?, ?, nullif(?, ''), nullif(?, ''))`,
+			now.Add(-time.Duration(row.minutesAgo)*time.Minute).UTC().Format("2006-01-02 15:04:05"), row.keys, row.class, row.title)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	rules, err := NewProjectRules(testProjectRules)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	changed, err := storage.Reclassify(rules)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if changed != 4 {
+		t.Fatalf("Expected 4 rows to be reclassified, got %d", changed)
+	}
+
+	// nothing changes the second time
+	if changed, _ = storage.Reclassify(rules); changed != 0 {
+		t.Fatalf("Expected no rows to be reclassified, got %d", changed)
+	}
+
+	counts, err := storage.ProjectCounts(now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []ProjectCount{
+		{"selfwatch", 200, 1},
+		{"moonscript", 150, 1},
+		{"chat", 30, 1},
+		{"", 5, 1},
+	}
+
+	if len(counts) != len(expected) {
+		t.Fatalf("Unexpected counts %+v", counts)
+	}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected[i], counts[i])
+		}
+	}
+
+	// dropping a rule clears the project of the rows it matched
+	changed, err = storage.Reclassify(&ProjectRules{})
+	if err != nil || changed != 4 {
+		t.Fatalf("Expected 4 rows to be cleared, got %d: %v", changed, err)
+	}
+}
+
+func TestWebProjects(t *testing.T) {
+	server := newTestWebServer(t, defaultConfig)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/projects?from=2024-03-01&to=2024-03-31")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var counts []ProjectCount
+	json.NewDecoder(res.Body).Decode(&counts)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || counts == nil || len(counts) != 0 {
+		t.Fatalf("Unexpected response %d %+v", res.StatusCode, counts)
+	}
+
+	res, err = http.Get(server.URL + "/api/projects?from=2024-03-31&to=2024-03-01")
+	expectStatus(t, res, err, http.StatusBadRequest)
+
+	res, err = http.Get(server.URL + "/api/projects?from=yesterday")
+	expectStatus(t, res, err, http.StatusBadRequest)
+}
@@ -0,0 +1,202 @@
+package selfwatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// Sync protocol versions. Version 1 is the original unversioned array of
+// [id, created_at, nrkeys] tuples, version 2 wraps typed rows in an envelope.
+const (
+	legacyProtocolVersion = 1
+	syncProtocolVersion   = 2
+
+	syncContentType = "application/vnd.selfwatch.v2+json"
+)
+
+// protocols and content encodings understood by SyncReceiver
+var (
+	supportedProtocols = []int{legacyProtocolVersion, syncProtocolVersion}
+	supportedEncodings = []string{"gzip"}
+)
+
+// upper bound on the size of a decompressed payload
+const maxDecodedPayload = 256 << 20
+
+// errUnsupportedEncoding is returned when decoding a payload sent with a
+// Content-Encoding the receiver doesn't understand
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// SyncEnvelope is the version 2 sync payload
+type SyncEnvelope struct {
+	Version int      `json:"version"`
+	Host    string   `json:"host"`
+	Rows    []KeyRow `json:"rows"`
+}
+
+// remoteInfo is returned from a GET to the remote. Receivers that predate
+// protocol negotiation only send max_id.
+type remoteInfo struct {
+	MaxId     int64    `json:"max_id"`
+	Protocols []int    `json:"protocols,omitempty"`
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+func (info *remoteInfo) supportsProtocol(version int) bool {
+	return slices.Contains(info.Protocols, version)
+}
+
+func (info *remoteInfo) supportsEncoding(encoding string) bool {
+	return slices.Contains(info.Encodings, encoding)
+}
+
+func serializeLegacyRows(rows []KeyRow) [][]interface{} {
+	var out [][]interface{}
+
+	for _, row := range rows {
+		// nrkeys has always been sent as a string in this format
+		out = append(out, []interface{}{
+			row.Id, row.CreatedAt, strconv.FormatInt(row.NrKeys, 10),
+		})
+	}
+
+	return out
+}
+
+// encodeSyncPayload serializes rows in the best format the remote supports,
+// returning the body and its content type. gzipped is true if the body was
+// compressed.
+func encodeSyncPayload(rows []KeyRow, host string, info *remoteInfo) (body []byte, contentType string, gzipped bool, err error) {
+	if info.supportsProtocol(syncProtocolVersion) {
+		contentType = syncContentType
+		body, err = json.Marshal(SyncEnvelope{
+			Version: syncProtocolVersion,
+			Host:    host,
+			Rows:    rows,
+		})
+	} else {
+		contentType = "application/json"
+		body, err = json.Marshal(serializeLegacyRows(rows))
+	}
+
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if info.supportsEncoding("gzip") {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err = writer.Write(body); err != nil {
+			return nil, "", false, err
+		}
+		if err = writer.Close(); err != nil {
+			return nil, "", false, err
+		}
+		return buf.Bytes(), contentType, true, nil
+	}
+
+	return body, contentType, false, nil
+}
+
+// decodeSyncPayload parses a payload sent with the given Content-Encoding.
+// The legacy format is a JSON array while newer versions are JSON objects.
+func decodeSyncPayload(body []byte, encoding string) (*SyncEnvelope, error) {
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		body, err = io.ReadAll(io.LimitReader(reader, maxDecodedPayload))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty sync payload")
+	}
+
+	if body[0] == '[' {
+		rows, err := parseLegacyRows(body)
+		if err != nil {
+			return nil, err
+		}
+		return &SyncEnvelope{Version: legacyProtocolVersion, Rows: rows}, nil
+	}
+
+	var envelope SyncEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	if envelope.Version != syncProtocolVersion {
+		return nil, fmt.Errorf("unsupported sync protocol version %d", envelope.Version)
+	}
+
+	return &envelope, nil
+}
+
+// decodeDecryptedPayload parses the plaintext of an encrypted chunk. Relays
+// store chunks without the headers they were sent with, so whether the
+// plaintext was gzipped is detected by its magic bytes, which are covered by
+// the encryption.
+func decodeDecryptedPayload(body []byte) (*SyncEnvelope, error) {
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		return decodeSyncPayload(body, "gzip")
+	}
+	return decodeSyncPayload(body, "")
+}
+
+// parseLegacyRows decodes the array of [id, created_at, nrkeys] tuples of
+// the version 1 format
+func parseLegacyRows(body []byte) ([]KeyRow, error) {
+	var raw [][]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	out := make([]KeyRow, 0, len(raw))
+
+	for _, fields := range raw {
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected 3 fields in row, got %d", len(fields))
+		}
+
+		var row KeyRow
+		if err := json.Unmarshal(fields[0], &row.Id); err != nil {
+			return nil, fmt.Errorf("invalid row id: %v", err)
+		}
+
+		if err := json.Unmarshal(fields[1], &row.CreatedAt); err != nil {
+			return nil, fmt.Errorf("invalid row created_at: %v", err)
+		}
+
+		// nrkeys is sent as a string, but accept numbers too
+		var nrkeys string
+		if err := json.Unmarshal(fields[2], &nrkeys); err != nil {
+			nrkeys = string(fields[2])
+		}
+
+		count, err := strconv.ParseInt(nrkeys, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid row nrkeys: %v", err)
+		}
+		row.NrKeys = count
+
+		out = append(out, row)
+	}
+
+	return out, nil
+}
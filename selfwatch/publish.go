@@ -0,0 +1,245 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many days of hourly data a static snapshot includes, matching the
+// dashboard's 30 day chart
+const publishDays = 30
+
+// PublishOptions controls what a static snapshot of the dashboard shares
+type PublishOptions struct {
+	// GeneratedAt is shown as the current time by the static dashboard
+	GeneratedAt string
+	// Round rounds every count to the nearest multiple of it when set
+	Round int64
+	// HideHours leaves out everything showing activity by hour
+	HideHours bool
+}
+
+func (o *PublishOptions) round(count int64) int64 {
+	if o.Round <= 1 {
+		return count
+	}
+	return (count + o.Round/2) / o.Round * o.Round
+}
+
+func (o *PublishOptions) roundDaily(counts []DailyCount) []DailyCount {
+	for i := range counts {
+		counts[i].Count = o.round(counts[i].Count)
+	}
+	return counts
+}
+
+func (o *PublishOptions) roundHourly(counts []HourlyCount) []HourlyCount {
+	for i := range counts {
+		counts[i].Count = o.round(counts[i].Count)
+	}
+	return counts
+}
+
+func (o *PublishOptions) roundBest(best *BestPeriod) {
+	if best != nil {
+		best.Count = o.round(best.Count)
+	}
+}
+
+// staticApiPath returns the file an API response is stored in, eg.
+// api/hourly/date-2024-12-10.json for /api/hourly?date=2024-12-10. The
+// frontend maps requests the same way in apiUrl.
+func staticApiPath(path string, query string) string {
+	name := strings.TrimPrefix(path, "/")
+	if query != "" {
+		name += "/" + strings.NewReplacer("=", "-", "&", "-").Replace(query)
+	}
+	return name + ".json"
+}
+
+// Publish writes the dashboard to dir with a snapshot of every API response
+// it uses, so it can be served by any static file host. Days and hours are
+// counted in now's location.
+func (ws *WebServer) Publish(dir string, opts PublishOptions, now time.Time) error {
+	loc := now.Location()
+	if opts.GeneratedAt == "" {
+		opts.GeneratedAt = now.Format(time.RFC3339)
+	}
+
+	writeJSON := func(path string, query string, v interface{}) error {
+		fname := filepath.Join(dir, filepath.FromSlash(staticApiPath(path, query)))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			return err
+		}
+
+		out, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(fname, out, 0644)
+	}
+
+	if err := ws.publishAssets(dir, &opts); err != nil {
+		return err
+	}
+
+	daily, err := ws.Storage.DailyCounts(publishDays, ws.Config.NewDayHour, now)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON("/api/daily", "", opts.roundDaily(daily)); err != nil {
+		return err
+	}
+
+	stats, err := ws.Storage.Stats(ws.Config.StreakThreshold, ws.Config.NewDayHour, now)
+	if err != nil {
+		return err
+	}
+
+	opts.roundBest(stats.BestDay)
+	opts.roundBest(stats.BestHour)
+	opts.roundBest(stats.BestWeek)
+	for i := range stats.WeekdayAverages {
+		stats.WeekdayAverages[i].Average = float64(opts.round(int64(stats.WeekdayAverages[i].Average)))
+	}
+	for i := range stats.YearTotals {
+		stats.YearTotals[i].Count = opts.round(stats.YearTotals[i].Count)
+	}
+	if opts.HideHours {
+		stats.BestHour = nil
+	}
+
+	if err := writeJSON("/api/stats", "", stats); err != nil {
+		return err
+	}
+
+	goals, err := ws.Storage.EvaluateGoals(ws.Config.Goals, ws.Config.NewDayHour, now)
+	if err != nil {
+		return err
+	}
+	for i := range goals {
+		goals[i].Value = opts.round(goals[i].Value)
+		goals[i].Progress = goalFraction(goals[i].Value, goals[i].Target)
+	}
+	if err := writeJSON("/api/goals", "", goals); err != nil {
+		return err
+	}
+
+	// every year with activity, and the current one which is shown first
+	years := map[int]bool{now.Year(): true}
+	for _, total := range stats.YearTotals {
+		if year, err := strconv.Atoi(total.Year); err == nil {
+			years[year] = true
+		}
+	}
+
+	for year := range years {
+		counts, err := ws.Storage.YearlyCounts(year, ws.Config.NewDayHour, loc)
+		if err != nil {
+			return err
+		}
+		if err := writeJSON("/api/yearly", fmt.Sprintf("year=%d", year), opts.roundDaily(counts)); err != nil {
+			return err
+		}
+
+		start := time.Date(year, 1, 1, ws.Config.NewDayHour, 0, 0, 0, loc)
+		annotations, err := ws.Storage.Annotations(start, start.AddDate(1, 0, 0), loc)
+		if err != nil {
+			return err
+		}
+		query := fmt.Sprintf("from=%d-01-01&to=%d-12-31", year, year)
+		if err := writeJSON("/api/annotations", query, annotations); err != nil {
+			return err
+		}
+	}
+
+	if opts.HideHours {
+		return nil
+	}
+
+	heatmap, err := ws.Storage.WeeklyHourlyGrid(now)
+	if err != nil {
+		return err
+	}
+	for i := range heatmap.Data {
+		heatmap.Data[i].Count = opts.round(heatmap.Data[i].Count)
+	}
+	if err := writeJSON("/api/weekly-heatmap", "", heatmap); err != nil {
+		return err
+	}
+
+	for offset := 0; offset < publishDays; offset++ {
+		counts, err := ws.Storage.HourlyCounts(24, offset, now)
+		if err != nil {
+			return err
+		}
+		if err := writeJSON("/api/hourly", fmt.Sprintf("offset=%d", offset), opts.roundHourly(counts)); err != nil {
+			return err
+		}
+
+		date := now.AddDate(0, 0, -offset).Format("2006-01-02")
+		counts, err = ws.Storage.HourlyCountsForDate(date, loc)
+		if err != nil {
+			return err
+		}
+		if err := writeJSON("/api/hourly", "date="+date, opts.roundHourly(counts)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishAssets writes index.html, configured for the static snapshot, and
+// the other dashboard files except the login page
+func (ws *WebServer) publishAssets(dir string, opts *PublishOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	indexTmpl, err := indexTemplate()
+	if err != nil {
+		return err
+	}
+
+	index, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	static := *ws
+	static.Static = opts
+	if err := indexTmpl.Execute(index, &static); err != nil {
+		return err
+	}
+
+	webFS, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		return err
+	}
+
+	return fs.WalkDir(webFS, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || path == "index.html" || path == "login.html" {
+			return err
+		}
+
+		content, err := fs.ReadFile(webFS, path)
+		if err != nil {
+			return err
+		}
+
+		fname := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(fname, content, 0644)
+	})
+}
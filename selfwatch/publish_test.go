@@ -0,0 +1,119 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticApiPath(t *testing.T) {
+	paths := map[string]string{
+		"/api/daily":                  "api/daily.json",
+		"/api/hourly?date=2024-12-10": "api/hourly/date-2024-12-10.json",
+		"/api/yearly?year=2024":       "api/yearly/year-2024.json",
+	}
+
+	for url, expected := range paths {
+		path, query, _ := strings.Cut(url, "?")
+		if got := staticApiPath(path, query); got != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, url, got)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	now := time.Now()
+	_, err := storage.db.Exec(`insert into keys(created_at, nrkeys) values(?, ?), (?, ?)`,
+		now.Add(-time.Minute).UTC().Format("2006-01-02 15:04:05"), 1234,
+		time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC).Format("2006-01-02 15:04:05"), 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cfg := defaultConfig
+	cfg.NewDayHour = 0
+	cfg.Goals = []GoalConfig{{Name: "type", Min: goalTarget(1000)}}
+	ws := NewWebServer(storage, &cfg, "", "test", "today")
+
+	readJSON := func(dir, fname string, v interface{}) {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(dir, fname))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := json.Unmarshal(content, v); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	dir := t.TempDir()
+	if err := ws.Publish(dir, PublishOptions{Round: 100}, now); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	index, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(index), "static: true") || !strings.Contains(string(index), "generatedAt: \""+now.Format(time.RFC3339)) {
+		t.Fatalf("Expected a static config in index.html:\n%s", index)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "login.html")); !os.IsNotExist(err) {
+		t.Fatal("Expected the login page to be left out")
+	}
+
+	var daily []DailyCount
+	readJSON(dir, "api/daily.json", &daily)
+	if len(daily) != 1 || daily[0].Count != 1200 {
+		t.Fatalf("Expected rounded daily counts, got %+v", daily)
+	}
+
+	var yearly []DailyCount
+	readJSON(dir, "api/yearly/year-2020.json", &yearly)
+	if len(yearly) != 1 || yearly[0].Count != 0 {
+		t.Fatalf("Expected rounded yearly counts, got %+v", yearly)
+	}
+
+	var hourly []HourlyCount
+	readJSON(dir, "api/hourly/date-"+now.Format("2006-01-02")+".json", &hourly)
+	readJSON(dir, "api/hourly/offset-29.json", &hourly)
+	readJSON(dir, "api/weekly-heatmap.json", &WeeklyHeatmapResponse{})
+
+	// progress is computed from the rounded count, and publishing doesn't
+	// store it
+	var goals []GoalProgress
+	readJSON(dir, "api/goals.json", &goals)
+	if len(goals) != 1 || goals[0].Value != 1200 || goals[0].Progress != 1.2 {
+		t.Fatalf("Expected rounded goal progress, got %+v", goals)
+	}
+
+	var stored int
+	if err := storage.db.QueryRow(`select count(*) from goals`).Scan(&stored); err != nil {
+		t.Fatal(err.Error())
+	}
+	if stored != 0 {
+		t.Fatalf("Expected no stored goals, got %d", stored)
+	}
+
+	// hiding hours leaves out the hourly snapshots
+	dir = t.TempDir()
+	if err := ws.Publish(dir, PublishOptions{HideHours: true}, now); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "api/hourly")); !os.IsNotExist(err) {
+		t.Fatal("Expected no hourly snapshots")
+	}
+
+	var stats Stats
+	readJSON(dir, "api/stats.json", &stats)
+	if stats.BestHour != nil || stats.BestDay == nil || stats.BestDay.Count != 1234 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
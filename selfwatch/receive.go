@@ -0,0 +1,258 @@
+package selfwatch
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maximum accepted size of a single sync request body
+const maxReceiveBody = 32 << 20
+
+// header carrying the id of the last row in an encrypted chunk, so a relay
+// without the key can still track how far a sender has synced
+const lastIdHeader = "X-Selfwatch-Last-Id"
+
+// number of blobs returned per request when importing from a relay
+const syncBlobPageSize = 100
+
+// Encrypted chunks stored by a receiver that doesn't have the key
+var syncBlobsSchema = `
+CREATE TABLE IF NOT EXISTS sync_blobs (
+	id INTEGER NOT NULL,
+	created_at DATETIME,
+	last_row_id INTEGER NOT NULL,
+	payload BLOB NOT NULL,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS ix_sync_blobs_last_row_id ON sync_blobs (last_row_id);
+`
+
+type SyncBlob struct {
+	LastRowId int64  `json:"last_row_id"`
+	Payload   []byte `json:"payload"`
+}
+
+type syncBlobsResponse struct {
+	Blobs []SyncBlob `json:"blobs"`
+}
+
+// SyncReceiver is the receiving side of RemoteSync. It reports the highest
+// row id it has stored on GET and stores posted rows on POST.
+type SyncReceiver struct {
+	Storage *WatchStorage
+
+	// Token, if set, must be presented as a bearer token
+	Token string
+	// Secret, if set, must have been used to sign the request
+	Secret string
+	// Key decrypts encrypted chunks. Without it encrypted chunks are stored
+	// as is, to be fetched later with RemoteSync.Import
+	Key []byte
+
+	// serve over TLS when set, requiring client certificates signed by
+	// ClientCAFile if that is set too
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+func NewSyncReceiver(storage *WatchStorage, cfg *config) (*SyncReceiver, error) {
+	var key []byte
+	if cfg.RemoteEncryptionKey != "" {
+		var err error
+		key, err = ParseEncryptionKey(cfg.RemoteEncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &SyncReceiver{
+		Storage: storage,
+		Token:   cfg.RemoteToken,
+		Secret:  cfg.RemoteSecret,
+		Key:     key,
+
+		CertFile:     cfg.ReceiveCertFile,
+		KeyFile:      cfg.ReceiveKeyFile,
+		ClientCAFile: cfg.ReceiveClientCAFile,
+	}, nil
+}
+
+func (sr *SyncReceiver) ListenAndServe(addr string) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: sr,
+	}
+
+	if sr.CertFile == "" {
+		if sr.ClientCAFile != "" {
+			return fmt.Errorf("ReceiveClientCAFile requires ReceiveCertFile")
+		}
+		log.Printf("Receiving sync at http://%s", addr)
+		return server.ListenAndServe()
+	}
+
+	cert, err := loadKeyPair(sr.CertFile, sr.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if sr.ClientCAFile != "" {
+		pool, err := loadCertPool(sr.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	log.Printf("Receiving sync at https://%s", addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+func (sr *SyncReceiver) authorize(r *http.Request, body []byte) error {
+	if sr.Token != "" {
+		auth := r.Header.Get("Authorization")
+		token, found := strings.CutPrefix(auth, "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(sr.Token)) != 1 {
+			return fmt.Errorf("invalid token")
+		}
+	}
+
+	if sr.Secret != "" {
+		if err := VerifySignature(r, body, sr.Secret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sr *SyncReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReceiveBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := sr.authorize(r, body); err != nil {
+		log.Printf("Rejected sync request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if after := r.URL.Query().Get("blobs_after"); after != "" {
+			sr.serveBlobs(w, after)
+			return
+		}
+
+		maxId, err := sr.Storage.MaxSyncedRowId()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(remoteInfo{
+			MaxId:     maxId,
+			Protocols: supportedProtocols,
+			Encodings: supportedEncodings,
+		})
+
+	case "POST":
+		var envelope *SyncEnvelope
+
+		if r.Header.Get(encryptionHeader) != "" {
+			if sr.Key == nil {
+				sr.storeBlob(w, r, body)
+				return
+			}
+
+			if r.Header.Get(encryptionHeader) != encryptionScheme {
+				http.Error(w, "Unsupported encryption", http.StatusBadRequest)
+				return
+			}
+
+			body, err = decryptPayload(sr.Key, body, r.Header.Get(lastIdHeader))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			envelope, err = decodeDecryptedPayload(body)
+		} else {
+			envelope, err = decodeSyncPayload(body, r.Header.Get("Content-Encoding"))
+		}
+
+		if errors.Is(err, errUnsupportedEncoding) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := sr.Storage.InsertKeyRows(envelope.Rows); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		from := r.RemoteAddr
+		if envelope.Host != "" {
+			from = envelope.Host + " (" + r.RemoteAddr + ")"
+		}
+		log.Printf("Received %d rows from %s", len(envelope.Rows), from)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (sr *SyncReceiver) storeBlob(w http.ResponseWriter, r *http.Request, body []byte) {
+	lastRowId, err := strconv.ParseInt(r.Header.Get(lastIdHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid "+lastIdHeader, http.StatusBadRequest)
+		return
+	}
+
+	if err := sr.Storage.InsertSyncBlob(lastRowId, body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stored encrypted chunk up to row %d from %s", lastRowId, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (sr *SyncReceiver) serveBlobs(w http.ResponseWriter, after string) {
+	afterId, err := strconv.ParseInt(after, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid blobs_after", http.StatusBadRequest)
+		return
+	}
+
+	blobs, err := sr.Storage.SyncBlobsAfter(afterId, syncBlobPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(syncBlobsResponse{Blobs: blobs})
+}
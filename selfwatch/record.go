@@ -7,6 +7,7 @@ package selfwatch
 #include <X11/Xlib.h>
 #include <X11/extensions/record.h>
 #include <X11/extensions/XTest.h>
+#include <X11/Xutil.h>
 
 void event_callback_cgo(XPointer priv, XRecordInterceptData *hook);
 */
@@ -31,8 +32,14 @@ type Recorder struct {
 	ButtonPress   func(Event)
 	ButtonRelease func(Event)
 	display       *C.Display
+
+	// window class by window id, windows don't change class
+	classes map[int64]string
 }
 
+// forget cached window classes once this many windows have been seen
+const maxCachedClasses = 1000
+
 func NewRecorder() *Recorder {
 	if instance != nil {
 		log.Fatal("recorder already exists")
@@ -144,3 +151,107 @@ func (r *Recorder) ListProperties(window C.Window) {
 	properties := C.XListProperties(r.display, window, &numProperties)
 	fmt.Println(numProperties, properties)
 }
+
+// WindowClass returns the WM_CLASS class name of window, or of its closest
+// ancestor that has one. Returns an empty string if it can't be found.
+func (r *Recorder) WindowClass(window int64) string {
+	if r.display == nil || window == 0 {
+		return ""
+	}
+
+	if class, found := r.classes[window]; found {
+		return class
+	}
+
+	if r.classes == nil || len(r.classes) >= maxCachedClasses {
+		r.classes = make(map[int64]string)
+	}
+
+	class := r.lookupWindowClass(C.Window(window))
+	r.classes[window] = class
+	return class
+}
+
+func (r *Recorder) lookupWindowClass(window C.Window) string {
+	for window != 0 {
+		var hint C.XClassHint
+		if C.XGetClassHint(r.display, window, &hint) != 0 {
+			class := C.GoString(hint.res_class)
+			C.XFree(unsafe.Pointer(hint.res_name))
+			C.XFree(unsafe.Pointer(hint.res_class))
+			return class
+		}
+
+		window = r.parentWindow(window)
+	}
+
+	return ""
+}
+
+// WindowTitle returns the title of window, or of its closest ancestor that
+// has one. Titles change, so unlike classes they aren't cached.
+func (r *Recorder) WindowTitle(window int64) string {
+	if r.display == nil || window == 0 {
+		return ""
+	}
+
+	for w := C.Window(window); w != 0; w = r.parentWindow(w) {
+		if title, found := r.windowName(w); found {
+			return title
+		}
+	}
+
+	return ""
+}
+
+// windowName reads _NET_WM_NAME, falling back to WM_NAME
+func (r *Recorder) windowName(window C.Window) (string, bool) {
+	netWmName := C.CString("_NET_WM_NAME")
+	defer C.free(unsafe.Pointer(netWmName))
+	utf8String := C.CString("UTF8_STRING")
+	defer C.free(unsafe.Pointer(utf8String))
+
+	nameAtom := C.XInternAtom(r.display, netWmName, C.False)
+	utf8Atom := C.XInternAtom(r.display, utf8String, C.False)
+
+	var actualType C.Atom
+	var format C.int
+	var count, remaining C.ulong
+	var data *C.uchar
+
+	if C.XGetWindowProperty(r.display, window, nameAtom, 0, 1024, C.False, utf8Atom,
+		&actualType, &format, &count, &remaining, &data) == C.Success && data != nil {
+		defer C.XFree(unsafe.Pointer(data))
+		if actualType == utf8Atom && format == 8 && count > 0 {
+			return C.GoStringN((*C.char)(unsafe.Pointer(data)), C.int(count)), true
+		}
+	}
+
+	var name *C.char
+	if C.XFetchName(r.display, window, &name) != 0 && name != nil {
+		defer C.XFree(unsafe.Pointer(name))
+		return C.GoString(name), true
+	}
+
+	return "", false
+}
+
+// parentWindow returns the parent of window, or 0 for top level windows
+func (r *Recorder) parentWindow(window C.Window) C.Window {
+	var root, parent C.Window
+	var children *C.Window
+	var count C.uint
+	if C.XQueryTree(r.display, window, &root, &parent, &children, &count) == 0 {
+		return 0
+	}
+
+	if children != nil {
+		C.XFree(unsafe.Pointer(children))
+	}
+
+	if parent == root {
+		return 0
+	}
+
+	return parent
+}
@@ -2,47 +2,247 @@ package selfwatch
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
-	"math"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
 	"time"
 )
 
+// maximum number of rows sent in a single request
+const syncChunkSize = 1000
+
+const (
+	signatureHeader = "X-Selfwatch-Signature"
+	timestampHeader = "X-Selfwatch-Timestamp"
+
+	// how far a signed request's timestamp may drift from the receiver's clock
+	maxSignatureSkew = 5 * time.Minute
+
+	// how long a sync request may take before giving up
+	remoteTimeout = 30 * time.Second
+)
+
 type RemoteSync struct {
 	Url     string
-	Storage *WatchStorage
+	Storage SyncStorage
+
+	// Token is sent as a bearer token when set
+	Token string
+	// Secret is used to HMAC sign every request when set
+	Secret string
+	// Client is used for all requests, http.DefaultClient if nil
+	Client *http.Client
+	// Key encrypts every chunk before it is sent when set
+	Key []byte
+	// Host identifies this machine in version 2 payloads
+	Host string
+}
+
+// NewRemoteSync creates a RemoteSync for the remote configured in cfg
+func NewRemoteSync(cfg *config, storage SyncStorage) (*RemoteSync, error) {
+	client, err := NewRemoteClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	if cfg.RemoteEncryptionKey != "" {
+		key, err = ParseEncryptionKey(cfg.RemoteEncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &RemoteSync{
+		Url:     cfg.RemoteUrl,
+		Storage: storage,
+		Token:   cfg.RemoteToken,
+		Secret:  cfg.RemoteSecret,
+		Client:  client,
+		Key:     key,
+		Host:    cfg.HostId(),
+	}, nil
+}
+
+// NewRemoteClient creates the http client used for syncing, presenting a
+// client certificate and trusting a custom CA if the config specifies them
+func NewRemoteClient(c *config) (*http.Client, error) {
+	if c.RemoteCertFile == "" && c.RemoteCAFile == "" {
+		return &http.Client{Timeout: remoteTimeout}, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if c.RemoteCertFile != "" {
+		cert, err := loadKeyPair(c.RemoteCertFile, c.RemoteKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.RemoteCAFile != "" {
+		pool, err := loadCertPool(c.RemoteCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   remoteTimeout,
+	}, nil
+}
+
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	certFile, err := expandHomePath(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyFile, err = expandHomePath(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+func loadCertPool(fname string) (*x509.CertPool, error) {
+	fname, err := expandHomePath(fname)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", fname)
+	}
+	return pool, nil
+}
+
+// signPayload computes the hex HMAC-SHA256 of the timestamp, method,
+// request URI and body, so a signature can't be replayed on another URL
+func signPayload(secret, timestamp, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range []string{timestamp, method, uri} {
+		mac.Write([]byte(part))
+		mac.Write([]byte("."))
+	}
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
 }
 
-type maxRows struct {
-	MaxId int64 `json:"max_id"`
+// signRequest sets the timestamp and signature headers of req
+func signRequest(req *http.Request, secret string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, signPayload(secret, timestamp, req.Method, req.URL.RequestURI(), body))
+}
+
+// VerifySignature checks the timestamp and signature headers of a request
+// signed by RemoteSync against the shared secret
+func VerifySignature(r *http.Request, body []byte, secret string) error {
+	timestamp := r.Header.Get(timestampHeader)
+	signature := r.Header.Get(signatureHeader)
+
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("missing signature")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp")
+	}
+
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return fmt.Errorf("signature timestamp out of range")
+	}
+
+	expected := signPayload(secret, timestamp, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+func (s *RemoteSync) do(method string, url string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	if s.Secret != "" {
+		signRequest(req, s.Secret, body)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(req)
 }
 
 func (s *RemoteSync) GetLastRowId() (int64, error) {
-	resp, err := http.Get(s.Url)
+	info, err := s.getRemoteInfo()
 	if err != nil {
 		return 0, err
 	}
+	return info.MaxId, nil
+}
+
+func (s *RemoteSync) getRemoteInfo() (*remoteInfo, error) {
+	resp, err := s.do("GET", s.Url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote returned %s", resp.Status)
 	}
 
-	var r maxRows
+	var r remoteInfo
 	log.Print(string(body))
 	err = json.Unmarshal(body, &r)
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return r.MaxId, nil
+	return &r, nil
 }
 
+// SendRows posts rows in the legacy format
 func (s *RemoteSync) SendRows(rows [][]interface{}) error {
 	payload, err := json.Marshal(rows)
 
@@ -50,7 +250,55 @@ func (s *RemoteSync) SendRows(rows [][]interface{}) error {
 		return err
 	}
 
-	res, err := http.Post(s.Url, "application/json", bytes.NewReader(payload))
+	if s.Key != nil && len(rows) > 0 {
+		return s.sendEncrypted(payload, fmt.Sprint(rows[len(rows)-1][0]))
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	return s.post(header, payload)
+}
+
+// sendChunk posts rows using the newest protocol and encoding the remote
+// advertises, falling back to the legacy format
+func (s *RemoteSync) sendChunk(rows []KeyRow, info *remoteInfo) error {
+	payload, contentType, gzipped, err := encodeSyncPayload(rows, s.Host, info)
+	if err != nil {
+		return err
+	}
+
+	if s.Key != nil {
+		return s.sendEncrypted(payload, strconv.FormatInt(rows[len(rows)-1].Id, 10))
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	if gzipped {
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	return s.post(header, payload)
+}
+
+// sendEncrypted encrypts a payload, which the receiver decodes after
+// decrypting by inspecting its contents
+func (s *RemoteSync) sendEncrypted(payload []byte, lastRowId string) error {
+	payload, err := encryptPayload(s.Key, payload, lastRowId)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set(encryptionHeader, encryptionScheme)
+	header.Set(lastIdHeader, lastRowId)
+
+	return s.post(header, payload)
+}
+
+func (s *RemoteSync) post(header http.Header, payload []byte) error {
+	res, err := s.do("POST", s.Url, header, payload)
 
 	if err != nil {
 		return err
@@ -58,50 +306,154 @@ func (s *RemoteSync) SendRows(rows [][]interface{}) error {
 
 	res.Body.Close()
 
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("remote returned %s", res.Status)
+	}
+
 	return nil
 }
 
+// FlushKeys queues new rows in the outbox and sends every unacknowledged
+// chunk in order, stopping at the first failure. The outcome is recorded so
+// it can be reported by `selfwatch status --sync`.
 func (s *RemoteSync) FlushKeys() error {
-	maxRowId, err := s.GetLastRowId()
-	rows, err := s.Storage.SerializeRecentKeyCounts(maxRowId)
+	err := s.flushOutbox()
+	if recordErr := s.Storage.RecordSyncAttempt(err); recordErr != nil {
+		log.Printf("Error recording sync status: %v", recordErr)
+	}
+	return err
+}
 
+func (s *RemoteSync) flushOutbox() error {
+	info, err := s.getRemoteInfo()
 	if err != nil {
 		return err
 	}
 
-	chunkSize := 1000
+	err = s.Storage.EnqueueSyncRows(s.Url, info.MaxId, syncChunkSize)
+	if err != nil {
+		return err
+	}
 
-	chunks := int(math.Ceil(float64(len(rows)) / float64(chunkSize)))
+	chunks, err := s.Storage.PendingSyncChunks()
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < chunks; i++ {
-		left := i * chunkSize
-		right := (i + 1) * chunkSize
-		if len(rows) < right {
-			right = len(rows)
+	for _, chunk := range chunks {
+		// the remote may have stored a chunk whose response we never saw
+		if chunk.LastRowId > info.MaxId {
+			rows, err := s.Storage.KeyCountsInIdRange(chunk.FirstRowId, chunk.LastRowId)
+			if err != nil {
+				return err
+			}
+
+			if len(rows) > 0 {
+				if err = s.sendChunk(rows, info); err != nil {
+					if failErr := s.Storage.FailSyncChunk(chunk.Id, err); failErr != nil {
+						log.Printf("Error recording failed sync chunk %d: %v", chunk.Id, failErr)
+					}
+					return err
+				}
+			}
 		}
 
-		err = s.SendRows(rows[left:right])
-		if err != nil {
+		if err = s.Storage.AckSyncChunk(chunk.Id); err != nil {
 			return err
 		}
-
 	}
 
 	return nil
 }
 
+// Import fetches the encrypted chunks stored by a relay and decrypts them into
+// Storage, starting after the highest row already stored locally. Returns
+// the number of rows imported.
+func (s *RemoteSync) Import() (int, error) {
+	if s.Key == nil {
+		return 0, fmt.Errorf("importing requires an encryption key")
+	}
+
+	_, afterId, err := s.Storage.GetLastKeyPress()
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+
+	for {
+		blobs, err := s.fetchBlobs(afterId)
+		if err != nil {
+			return imported, err
+		}
+
+		if len(blobs) == 0 {
+			return imported, nil
+		}
+
+		for _, blob := range blobs {
+			payload, err := decryptPayload(s.Key, blob.Payload, strconv.FormatInt(blob.LastRowId, 10))
+			if err != nil {
+				return imported, err
+			}
+
+			envelope, err := decodeDecryptedPayload(payload)
+			if err != nil {
+				return imported, err
+			}
+
+			if err = s.Storage.InsertKeyRows(envelope.Rows); err != nil {
+				return imported, err
+			}
+
+			imported += len(envelope.Rows)
+			afterId = blob.LastRowId
+		}
+	}
+}
+
+func (s *RemoteSync) fetchBlobs(afterId int64) ([]SyncBlob, error) {
+	url, err := neturl.Parse(s.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Query()
+	query.Set("blobs_after", strconv.FormatInt(afterId, 10))
+	url.RawQuery = query.Encode()
+
+	resp, err := s.do("GET", url.String(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote returned %s", resp.Status)
+	}
+
+	var r syncBlobsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	return r.Blobs, nil
+}
+
 func (r *RemoteSync) FlushEvery(seconds float64) chan bool {
 	stop := make(chan bool)
 	go func() {
 		for {
+			if err := r.FlushKeys(); err != nil {
+				log.Printf("Error syncing keys: %v", err)
+			}
+
 			select {
 			case <-stop:
-				break
-			default:
+				return
+			case <-time.After(time.Duration(seconds * float64(time.Second))):
 			}
-
-			r.FlushKeys()
-			time.Sleep(60 * time.Second)
 		}
 	}()
 
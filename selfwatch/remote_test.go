@@ -0,0 +1,382 @@
+package selfwatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testRemoteDbName = "test_remote.db"
+
+func newTestStorage(t *testing.T, fname string) *WatchStorage {
+	removeDb(fname)
+
+	storage, err := NewWatchStorage(fname)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = storage.CreateSchema(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = storage.UpdateSchema(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return storage
+}
+
+func TestRemoteSyncAuthenticated(t *testing.T) {
+	local := newTestStorage(t, testDbName)
+	remote := newTestStorage(t, testRemoteDbName)
+	defer removeDb(testRemoteDbName)
+
+	for _, keys := range []int{5, 2, 6} {
+		if err := local.WriteKeys(keys); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	receiver := &SyncReceiver{
+		Storage: remote,
+		Token:   "token",
+		Secret:  "secret",
+	}
+
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	unauthenticated := RemoteSync{Url: server.URL, Storage: local}
+	if err := unauthenticated.FlushKeys(); err == nil {
+		t.Fatal("Expected unauthenticated sync to fail")
+	}
+
+	badSecret := RemoteSync{Url: server.URL, Storage: local, Token: "token", Secret: "wrong"}
+	if err := badSecret.FlushKeys(); err == nil {
+		t.Fatal("Expected sync with wrong secret to fail")
+	}
+
+	sync := RemoteSync{Url: server.URL, Storage: local, Token: "token", Secret: "secret"}
+	if err := sync.FlushKeys(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	maxId, err := sync.GetLastRowId()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if maxId != 3 {
+		t.Fatalf("Expected remote max id 3, got %d", maxId)
+	}
+
+	// a captured signature can't be replayed on another URL or method
+	signed, err := http.NewRequest("GET", server.URL+"/?host=laptop", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signed.Header.Set("Authorization", "Bearer token")
+	signRequest(signed, "secret", nil)
+
+	res, err := http.DefaultClient.Do(signed)
+	expectStatus(t, res, err, http.StatusOK)
+
+	for _, replay := range []struct{ method, url string }{
+		{"GET", server.URL + "/?host=desktop"},
+		{"GET", server.URL + "/?blobs_after=0"},
+		{"POST", server.URL + "/?host=laptop"},
+	} {
+		req, err := http.NewRequest(replay.method, replay.url, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header = signed.Header.Clone()
+
+		res, err := http.DefaultClient.Do(req)
+		expectStatus(t, res, err, http.StatusUnauthorized)
+	}
+}
+
+func TestRemoteSyncEncryptedRelay(t *testing.T) {
+	const testImportDbName = "test_import.db"
+
+	local := newTestStorage(t, testDbName)
+	relay := newTestStorage(t, testRemoteDbName)
+	imported := newTestStorage(t, testImportDbName)
+	defer removeDb(testRemoteDbName)
+	defer removeDb(testImportDbName)
+
+	for _, keys := range []int{5, 2, 6} {
+		if err := local.WriteKeys(keys); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	encoded, err := GenerateEncryptionKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	key, err := ParseEncryptionKey(encoded)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server := httptest.NewServer(&SyncReceiver{Storage: relay})
+	defer server.Close()
+
+	sync := RemoteSync{Url: server.URL, Storage: local, Key: key}
+	if err := sync.FlushKeys(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the relay only has ciphertext but still knows how far the sender got
+	_, relayKeys, err := relay.GetLastKeyPress()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if relayKeys != 0 {
+		t.Fatal("Expected relay to store no plaintext rows")
+	}
+
+	maxId, err := sync.GetLastRowId()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if maxId != 3 {
+		t.Fatalf("Expected relay max id 3, got %d", maxId)
+	}
+
+	importer := RemoteSync{Url: server.URL, Storage: imported, Key: key}
+	count, err := importer.Import()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if count != 3 {
+		t.Fatalf("Expected 3 imported rows, got %d", count)
+	}
+
+	// a relay that changes the last row id of a chunk can't make the
+	// importer skip rows
+	if _, err := relay.db.Exec(`update sync_blobs set last_row_id = 100`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	importer = RemoteSync{Url: server.URL, Storage: newTestStorage(t, testImportDbName), Key: key}
+	if _, err := importer.Import(); err == nil {
+		t.Fatal("Expected import of a chunk with a changed last row id to fail")
+	}
+
+	wrongKey := make([]byte, len(key))
+	importer = RemoteSync{Url: server.URL, Storage: newTestStorage(t, testImportDbName), Key: wrongKey}
+	if _, err := importer.Import(); err == nil {
+		t.Fatal("Expected import with the wrong key to fail")
+	}
+}
+
+func TestReceiveContentEncoding(t *testing.T) {
+	remote := newTestStorage(t, testRemoteDbName)
+	defer removeDb(testRemoteDbName)
+
+	server := httptest.NewServer(&SyncReceiver{Storage: remote})
+	defer server.Close()
+
+	payload := []byte(`{"version": 2, "rows": [{"id": 1, "created_at": "2024-03-01 12:00:00", "nrkeys": 5}]}`)
+
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write(payload)
+	writer.Close()
+
+	post := func(body []byte, encoding string) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+		req.Header.Set("Content-Type", syncContentType)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	res, err := post(gzipped.Bytes(), "gzip")
+	expectStatus(t, res, err, http.StatusNoContent)
+
+	// gzip is only decoded when the header says so
+	res, err = post(gzipped.Bytes(), "")
+	expectStatus(t, res, err, http.StatusBadRequest)
+
+	res, err = post(payload, "br")
+	expectStatus(t, res, err, http.StatusUnsupportedMediaType)
+
+	total, err := remote.TotalKeys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total != 5 {
+		t.Fatalf("Expected 5 keys received, got %d", total)
+	}
+}
+
+func TestRemoteSyncLegacyFallback(t *testing.T) {
+	local := newTestStorage(t, testDbName)
+
+	for _, keys := range []int{5, 2} {
+		if err := local.WriteKeys(keys); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	var received [][]interface{}
+
+	// a receiver that predates protocol negotiation
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`{"max_id": 0}`))
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "" {
+			t.Errorf("Unexpected content encoding %s", r.Header.Get("Content-Encoding"))
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("Expected legacy array payload: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	sync := RemoteSync{Url: server.URL, Storage: local, Host: "test"}
+	if err := sync.FlushKeys(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(received))
+	}
+
+	if received[0][2] != "5" {
+		t.Fatalf("Expected nrkeys sent as string, got %v", received[0][2])
+	}
+}
+
+func TestRemoteSyncOutboxResume(t *testing.T) {
+	local := newTestStorage(t, testDbName)
+	remote := newTestStorage(t, testRemoteDbName)
+	defer removeDb(testRemoteDbName)
+
+	for _, keys := range []int{5, 2, 6} {
+		if err := local.WriteKeys(keys); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	receiver := &SyncReceiver{Storage: remote}
+	failing := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	sync := RemoteSync{Url: server.URL, Storage: local}
+	if err := sync.FlushKeys(); err == nil {
+		t.Fatal("Expected sync to fail")
+	}
+
+	status, err := local.SyncStatus()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if status.LastError == "" || status.LastSuccess != nil {
+		t.Fatal("Expected failed sync to be recorded")
+	}
+
+	if status.PendingRows != 3 || status.PendingChunks != 1 {
+		t.Fatalf("Expected 3 pending rows in 1 chunk, got %d in %d", status.PendingRows, status.PendingChunks)
+	}
+
+	if err := local.WriteKeys(1); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	failing = false
+	if err := sync.FlushKeys(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	status, err = local.SyncStatus()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if status.LastError != "" || status.PendingRows != 0 || status.PendingChunks != 0 {
+		t.Fatalf("Expected sync to be caught up, got %+v", status)
+	}
+
+	if status.AckedRowId != 4 {
+		t.Fatalf("Expected acked row 4, got %d", status.AckedRowId)
+	}
+
+	// the remote is restored from a backup missing acknowledged rows, which
+	// are sent again
+	if _, err := remote.db.Exec(`delete from keys where id > 1`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := sync.FlushKeys(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	total, err := remote.TotalKeys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total != 14 {
+		t.Fatalf("Expected the remote to have all 14 keys again, got %d", total)
+	}
+
+	status, err = local.SyncStatus()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if status.AckedRowId != 4 || status.PendingChunks != 0 {
+		t.Fatalf("Expected sync to be caught up, got %+v", status)
+	}
+}
+
+func TestSyncStatusLag(t *testing.T) {
+	local := newTestStorage(t, testDbName)
+
+	now := time.Date(2024, 3, 13, 12, 0, 0, 0, time.UTC)
+	local.SetClock(ClockFunc(func() time.Time { return now }))
+
+	if err := local.WriteKeys(3); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now = now.Add(90 * time.Second)
+	if err := local.EnqueueSyncRows("http://remote", 0, 100); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	status, err := local.SyncStatus()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if status.LagSeconds != 90 {
+		t.Fatalf("Expected 90 seconds of lag, got %v", status.LagSeconds)
+	}
+}
@@ -0,0 +1,275 @@
+package selfwatch
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SVGTheme holds the colors used to render charts, as CSS hex colors
+type SVGTheme struct {
+	Background string
+	Text       string
+	// contribution grid cells are mixed from Low to High by activity, days
+	// without keys are Empty
+	Empty string
+	Low   string
+	High  string
+	Bar   string
+}
+
+// SVGThemes match the dashboard (dark) and GitHub's light contribution graph
+var SVGThemes = map[string]SVGTheme{
+	"dark": {
+		Background: "#161b22",
+		Text:       "#8b949e",
+		Empty:      "#21262d",
+		Low:        "#0e4429",
+		High:       "#39d353",
+		Bar:        "#f778ba",
+	},
+	"light": {
+		Background: "#ffffff",
+		Text:       "#57606a",
+		Empty:      "#ebedf0",
+		Low:        "#9be9a8",
+		High:       "#216e39",
+		Bar:        "#bf3989",
+	},
+}
+
+// ParseSVGTheme looks up a theme by name, dark if empty
+func ParseSVGTheme(name string) (SVGTheme, error) {
+	if name == "" {
+		name = "dark"
+	}
+	theme, ok := SVGThemes[name]
+	if !ok {
+		return SVGTheme{}, fmt.Errorf("invalid theme: %s", name)
+	}
+	return theme, nil
+}
+
+// isHexColor checks for a #rgb or #rrggbb color
+func isHexColor(color string) bool {
+	if !strings.HasPrefix(color, "#") || (len(color) != 4 && len(color) != 7) {
+		return false
+	}
+	_, err := strconv.ParseUint(color[1:], 16, 32)
+	return err == nil
+}
+
+func parseHexColor(color string) (r, g, b float64) {
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	value, _ := strconv.ParseUint(hex, 16, 32)
+	return float64(value >> 16 & 0xff), float64(value >> 8 & 0xff), float64(value & 0xff)
+}
+
+// mixColor mixes p of to into from, like CSS color-mix
+func mixColor(from, to string, p float64) string {
+	p = min(1, max(0, p))
+	r1, g1, b1 := parseHexColor(from)
+	r2, g2, b2 := parseHexColor(to)
+	mix := func(a, b float64) int {
+		return int(a + (b-a)*p + 0.5)
+	}
+	return fmt.Sprintf("#%02x%02x%02x", mix(r1, r2), mix(g1, g2), mix(b1, b2))
+}
+
+const svgFont = `font-family="-apple-system, BlinkMacSystemFont, 'Segoe UI', Helvetica, Arial, sans-serif"`
+
+// contribution grid layout, matching the dashboard's CSS
+const (
+	gridCell     = 11
+	gridGap      = 3
+	gridPadding  = 16
+	gridLabels   = 32
+	gridMonthRow = 15
+)
+
+// RenderContributions draws a year of daily counts as a contribution grid
+// with a column for each week, starting on Sunday
+func RenderContributions(w io.Writer, counts []DailyCount, year int, theme SVGTheme) error {
+	months := []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+	weekdays := []string{"", "Mon", "", "Wed", "", "Fri", ""}
+
+	countByDay := make(map[string]int64)
+	var maxCount int64 = 1
+	for _, count := range counts {
+		countByDay[count.Day] = count.Count
+		maxCount = max(maxCount, count.Count)
+	}
+
+	startOfYear := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	gridStart := startOfYear.AddDate(0, 0, -int(startOfYear.Weekday()))
+	endOfYear := time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)
+	// usually 53 weeks, 54 when a leap year starts on Saturday
+	totalWeeks := int(endOfYear.Sub(gridStart).Hours()/24)/7 + 1
+
+	cellX := func(week int) int {
+		return gridPadding + gridLabels + week*(gridCell+gridGap)
+	}
+	cellY := func(day int) int {
+		return gridPadding + gridMonthRow + day*(gridCell+gridGap)
+	}
+
+	width := cellX(totalWeeks) - gridGap + gridPadding
+	legendY := cellY(7) + 8
+	height := legendY + gridCell + gridPadding
+
+	var out strings.Builder
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	fmt.Fprintf(&out, `<rect width="100%%" height="100%%" rx="6" fill="%s"/>`, theme.Background)
+	fmt.Fprintf(&out, `<g %s font-size="10" fill="%s">`, svgFont, theme.Text)
+
+	currentMonth := -1
+	for week := 0; week < totalWeeks; week++ {
+		weekStart := gridStart.AddDate(0, 0, week*7)
+		if int(weekStart.Month()) != currentMonth && weekStart.Year() == year {
+			currentMonth = int(weekStart.Month())
+			fmt.Fprintf(&out, `<text x="%d" y="%d">%s</text>`, cellX(week), gridPadding+9, months[currentMonth-1])
+		}
+	}
+
+	for day, label := range weekdays {
+		if label != "" {
+			fmt.Fprintf(&out, `<text x="%d" y="%d" text-anchor="end">%s</text>`, gridPadding+gridLabels-4, cellY(day)+9, label)
+		}
+	}
+
+	out.WriteString(`</g>`)
+
+	cellColor := func(p float64) string {
+		if p <= 0 {
+			return theme.Empty
+		}
+		return mixColor(theme.Low, theme.High, p)
+	}
+
+	for week := 0; week < totalWeeks; week++ {
+		for day := 0; day < 7; day++ {
+			date := gridStart.AddDate(0, 0, week*7+day)
+			if date.Year() != year {
+				continue
+			}
+
+			key := date.Format("2006-01-02")
+			count := countByDay[key]
+			fmt.Fprintf(&out, `<rect x="%d" y="%d" width="%d" height="%d" rx="2" fill="%s"><title>%s: %d keys</title></rect>`,
+				cellX(week), cellY(day), gridCell, gridCell, cellColor(float64(count)/float64(maxCount)),
+				date.Format("Mon, Jan 2"), count)
+		}
+	}
+
+	// legend in the bottom right corner
+	legendSteps := []float64{0, 0.25, 0.5, 0.75, 1}
+	legendX := width - gridPadding - 28 - len(legendSteps)*(gridCell+gridGap)
+	fmt.Fprintf(&out, `<g %s font-size="12" fill="%s">`, svgFont, theme.Text)
+	fmt.Fprintf(&out, `<text x="%d" y="%d" text-anchor="end">Less</text>`, legendX-4, legendY+10)
+	fmt.Fprintf(&out, `<text x="%d" y="%d">More</text>`, legendX+len(legendSteps)*(gridCell+gridGap)+1, legendY+10)
+	out.WriteString(`</g>`)
+
+	for i, p := range legendSteps {
+		fmt.Fprintf(&out, `<rect x="%d" y="%d" width="%d" height="%d" rx="2" fill="%s"/>`,
+			legendX+i*(gridCell+gridGap), legendY, gridCell, gridCell, cellColor(p))
+	}
+
+	out.WriteString(`</svg>`)
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// ChartBar is a labeled bar of a bar chart
+type ChartBar struct {
+	Label string
+	Title string
+	Count int64
+}
+
+// bar chart layout, matching the dashboard's CSS
+const (
+	barChartHeight = 136
+	barAreaHeight  = 140
+	barGap         = 6
+	barLabelHeight = 16
+)
+
+// RenderBarChart draws bars scaled to the largest count, filling width
+func RenderBarChart(w io.Writer, bars []ChartBar, width int, theme SVGTheme) error {
+	height := gridPadding*2 + barAreaHeight + barLabelHeight
+
+	var out strings.Builder
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	fmt.Fprintf(&out, `<rect width="100%%" height="100%%" rx="6" fill="%s"/>`, theme.Background)
+
+	if len(bars) == 0 {
+		fmt.Fprintf(&out, `<text x="%d" y="%d" text-anchor="middle" %s font-size="14" fill="%s">No data</text>`,
+			width/2, height/2, svgFont, theme.Text)
+	} else {
+		var maxCount int64
+		for _, bar := range bars {
+			maxCount = max(maxCount, bar.Count)
+		}
+
+		barWidth := (float64(width-gridPadding*2) - float64(barGap*(len(bars)-1))) / float64(len(bars))
+		bottom := float64(gridPadding + barAreaHeight)
+
+		fmt.Fprintf(&out, `<g %s font-size="10" fill="%s" text-anchor="middle">`, svgFont, theme.Text)
+		for i, bar := range bars {
+			x := float64(gridPadding) + float64(i)*(barWidth+barGap)
+
+			barHeight := 0.0
+			if maxCount > 0 {
+				barHeight = float64(bar.Count) / float64(maxCount) * barChartHeight
+			}
+			if bar.Count > 0 {
+				barHeight = max(barHeight, 2)
+			}
+
+			title := bar.Title
+			if title == "" {
+				title = bar.Label
+			}
+
+			fmt.Fprintf(&out, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" rx="2" fill="%s"><title>%s: %d keys</title></rect>`,
+				x, bottom-barHeight, barWidth, barHeight, theme.Bar, html.EscapeString(title), bar.Count)
+			fmt.Fprintf(&out, `<text x="%.1f" y="%.1f">%s</text>`, x+barWidth/2, bottom+barLabelHeight-2, html.EscapeString(bar.Label))
+		}
+		out.WriteString(`</g>`)
+	}
+
+	out.WriteString(`</svg>`)
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// DailyBars returns a bar for each of the last days days, ending today, as
+// shown on the dashboard. Days start at newDayHour.
+func DailyBars(counts []DailyCount, days int, newDayHour int, now time.Time) []ChartBar {
+	countByDay := make(map[string]int64)
+	for _, count := range counts {
+		countByDay[count.Day] = count.Count
+	}
+
+	today := logicalDate(now, newDayHour)
+
+	bars := make([]ChartBar, 0, days)
+	for i := days - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		key := day.Format("2006-01-02")
+		bars = append(bars, ChartBar{
+			Label: strconv.Itoa(day.Day()),
+			Title: key,
+			Count: countByDay[key],
+		})
+	}
+	return bars
+}
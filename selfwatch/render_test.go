@@ -0,0 +1,122 @@
+package selfwatch
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMixColor(t *testing.T) {
+	if color := mixColor("#000000", "#ffffff", 0.5); color != "#808080" {
+		t.Fatalf("Expected #808080, got %s", color)
+	}
+
+	if color := mixColor("#1f2630", "#39d353", 1); color != "#39d353" {
+		t.Fatalf("Expected #39d353, got %s", color)
+	}
+
+	if color := mixColor("#000", "#fff", 2); color != "#ffffff" {
+		t.Fatalf("Expected #ffffff, got %s", color)
+	}
+}
+
+func TestRenderContributions(t *testing.T) {
+	counts := []DailyCount{
+		{"2024-01-01", 100},
+		{"2024-06-15", 400},
+	}
+
+	var out strings.Builder
+	if err := RenderContributions(&out, counts, 2024, SVGThemes["light"]); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	svg := out.String()
+	if err := xml.Unmarshal([]byte(svg), new(interface{})); err != nil {
+		t.Fatalf("Expected valid XML: %v", err)
+	}
+
+	// one cell for every day of the leap year, plus the legend
+	if cells := strings.Count(svg, " keys</title></rect>"); cells != 366 {
+		t.Fatalf("Expected 366 cells, got %d", cells)
+	}
+
+	if !strings.Contains(svg, `fill="#216e39"><title>Sat, Jun 15: 400 keys</title>`) {
+		t.Fatal("Expected the busiest day to use the high color")
+	}
+
+	if !strings.Contains(svg, `fill="#ebedf0"><title>Tue, Jan 2: 0 keys</title>`) {
+		t.Fatal("Expected a day without keys to use the empty color")
+	}
+}
+
+func TestRenderContributionsLongYear(t *testing.T) {
+	// 2028 starts on a Saturday and ends on a Sunday in a 54th week
+	var out strings.Builder
+	if err := RenderContributions(&out, []DailyCount{{"2028-12-31", 10}}, 2028, SVGThemes["light"]); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	svg := out.String()
+	if cells := strings.Count(svg, " keys</title></rect>"); cells != 366 {
+		t.Fatalf("Expected 366 cells, got %d", cells)
+	}
+
+	if !strings.Contains(svg, `<title>Sun, Dec 31: 10 keys</title>`) {
+		t.Fatal("Expected a cell for December 31st")
+	}
+}
+
+func TestRenderDaily(t *testing.T) {
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	bars := DailyBars([]DailyCount{{"2024-03-05", 50}}, 7, 4, now)
+
+	if len(bars) != 7 || bars[5] != (ChartBar{Label: "5", Title: "2024-03-05", Count: 50}) {
+		t.Fatalf("Unexpected bars %+v", bars)
+	}
+
+	// at 2:00 the last bar is still the day before
+	bars = DailyBars([]DailyCount{{"2024-03-05", 50}}, 7, 4, now.Add(-10*time.Hour))
+	if bars[6] != (ChartBar{Label: "5", Title: "2024-03-05", Count: 50}) {
+		t.Fatalf("Expected the last bar to be the day before, got %+v", bars[6])
+	}
+
+	var out strings.Builder
+	if err := RenderBarChart(&out, bars, 300, SVGThemes["dark"]); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !strings.Contains(out.String(), `height="136.0" rx="2" fill="#f778ba"><title>2024-03-05: 50 keys</title>`) {
+		t.Fatalf("Expected a full height bar, got %s", out.String())
+	}
+
+	server := newTestWebServer(t, defaultConfig)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/render/daily.svg?theme=light&bg=transparent&color=0af")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("Unexpected response %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	if !strings.Contains(string(body), `fill="transparent"`) {
+		t.Fatal("Expected a transparent background")
+	}
+
+	res, err = http.Get(server.URL + "/api/render/contributions.svg?theme=neon")
+	expectStatus(t, res, err, http.StatusBadRequest)
+
+	res, err = http.Get(server.URL + "/api/render/contributions.svg?year=2024&color=zzz")
+	expectStatus(t, res, err, http.StatusBadRequest)
+
+	res, err = http.Get(server.URL + "/api/render/contributions.svg?year=2024")
+	expectStatus(t, res, err, http.StatusOK)
+}
@@ -0,0 +1,432 @@
+package selfwatch
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formats accepted by Report.Write
+const (
+	ReportFormatText     = "text"
+	ReportFormatMarkdown = "markdown"
+	ReportFormatHTML     = "html"
+)
+
+// how many entries the busiest and top lists of a report have
+const reportTopCount = 5
+
+type AppCount struct {
+	App   string `json:"app"`
+	Count int64  `json:"count"`
+}
+
+type HourOfDayCount struct {
+	Hour  int   `json:"hour"`
+	Count int64 `json:"count"`
+}
+
+type ReportSession struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Minutes int64     `json:"minutes"`
+	Keys    int64     `json:"keys"`
+}
+
+// Report is a digest of the activity in a week or month, compared to the
+// period before it
+type Report struct {
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+
+	Total         int64 `json:"total"`
+	PreviousTotal int64 `json:"previousTotal"`
+	ActiveMinutes int64 `json:"activeMinutes"`
+
+	// every day of the period, including ones without keys
+	Days         []RangeCount     `json:"days"`
+	BusiestDays  []RangeCount     `json:"busiestDays"`
+	BusiestHours []HourOfDayCount `json:"busiestHours"`
+	TopApps      []AppCount       `json:"topApps"`
+
+	Sessions       int            `json:"sessions"`
+	SessionMinutes int64          `json:"sessionMinutes"`
+	LongestSession *ReportSession `json:"longestSession"`
+
+	CurrentStreak Streak `json:"currentStreak"`
+	LongestStreak Streak `json:"longestStreak"`
+}
+
+// Change is the percent change of the total from the previous period, 0 if
+// the previous period had no keys
+func (r *Report) Change() float64 {
+	if r.PreviousTotal == 0 {
+		return 0
+	}
+	return float64(r.Total-r.PreviousTotal) / float64(r.PreviousTotal) * 100
+}
+
+// Title describes the period, eg. "Week of 2024-03-04" or "March 2024"
+func (r *Report) Title() string {
+	if r.Period == BucketMonth {
+		return r.Start.Format("January 2006")
+	}
+	return "Week of " + r.Start.Format("2006-01-02")
+}
+
+// LastDay is the date of the last day in the period
+func (r *Report) LastDay() string {
+	return r.End.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// ReportRange returns the week or month containing now, moved back offset
+// periods. Weeks start on Monday and days start at newDayHour.
+func ReportRange(period string, now time.Time, newDayHour int, offset int) (time.Time, time.Time, error) {
+	day := LogicalDayStart(now, newDayHour)
+
+	switch period {
+	case BucketWeek:
+		start := day.AddDate(0, 0, -((int(day.Weekday())+6)%7)-7*offset)
+		return start, start.AddDate(0, 0, 7), nil
+	case BucketMonth:
+		start := time.Date(day.Year(), day.Month()-time.Month(offset), 1, newDayHour, 0, 0, 0, day.Location())
+		return start, start.AddDate(0, 1, 0), nil
+	}
+
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid report period: %s", period)
+}
+
+// Report summarizes the activity in [from, to) and compares it to the period
+// of the same length before it. Sessions end after sessionIdle without keys,
+// streaks are computed as of the end of the period.
+func (s *WatchStorage) Report(period string, from, to time.Time, newDayHour int, sessionIdle time.Duration, threshold int64) (*Report, error) {
+	loc := from.Location()
+	report := &Report{
+		Period:       period,
+		Start:        from,
+		End:          to,
+		Days:         make([]RangeCount, 0),
+		BusiestDays:  make([]RangeCount, 0),
+		BusiestHours: make([]HourOfDayCount, 0),
+	}
+
+	minutes, err := s.minuteCounts(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// the previous period by the calendar, periods spanning a daylight saving
+	// change are an hour shorter or longer
+	previousFrom, _, err := ReportRange(period, from.Add(-time.Second), newDayHour, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	report.PreviousTotal, err = s.TotalCount(previousFrom, from)
+	if err != nil {
+		return nil, err
+	}
+
+	days := make(map[string]int64)
+	var hours [24]int64
+	active := make([]activeMinute, 0, len(minutes))
+
+	for minute, count := range minutes {
+		local := minute.In(loc)
+		report.Total += count
+		days[bucketKey(local, BucketDay, newDayHour)] += count
+		hours[local.Hour()] += count
+		active = append(active, activeMinute{time: minute, keys: count})
+	}
+	report.ActiveMinutes = int64(len(minutes))
+
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		report.Days = append(report.Days, RangeCount{Bucket: key, Count: days[key]})
+	}
+
+	for _, day := range report.Days {
+		if day.Count > 0 {
+			report.BusiestDays = append(report.BusiestDays, day)
+		}
+	}
+	sort.SliceStable(report.BusiestDays, func(i, j int) bool {
+		return report.BusiestDays[i].Count > report.BusiestDays[j].Count
+	})
+	if len(report.BusiestDays) > reportTopCount {
+		report.BusiestDays = report.BusiestDays[:reportTopCount]
+	}
+
+	for hour, count := range hours {
+		if count > 0 {
+			report.BusiestHours = append(report.BusiestHours, HourOfDayCount{Hour: hour, Count: count})
+		}
+	}
+	sort.SliceStable(report.BusiestHours, func(i, j int) bool {
+		return report.BusiestHours[i].Count > report.BusiestHours[j].Count
+	})
+	if len(report.BusiestHours) > reportTopCount {
+		report.BusiestHours = report.BusiestHours[:reportTopCount]
+	}
+
+	report.TopApps, err = s.AppCounts(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(report.TopApps) > reportTopCount {
+		report.TopApps = report.TopApps[:reportTopCount]
+	}
+
+	for _, session := range groupSessions(active, sessionIdle, newDayHour, loc) {
+		minutes := int64(session.end.Sub(session.start) / time.Minute)
+		report.Sessions += 1
+		report.SessionMinutes += minutes
+		if report.LongestSession == nil || minutes > report.LongestSession.Minutes {
+			report.LongestSession = &ReportSession{
+				Start:   session.start,
+				End:     session.end,
+				Minutes: minutes,
+				Keys:    session.keys,
+			}
+		}
+	}
+
+	// streaks as of the end of the period, or now for the current period
+	asOf := to.Add(-time.Minute)
+	if now := s.Now().In(loc); now.Before(asOf) {
+		asOf = now
+	}
+
+	stats, err := s.Stats(threshold, newDayHour, asOf)
+	if err != nil {
+		return nil, err
+	}
+	report.CurrentStreak = stats.CurrentStreak
+	report.LongestStreak = stats.LongestStreak
+
+	return report, nil
+}
+
+// AppCounts sums keys in [from, to) by window class, most keys first. Keys
+// recorded without a window class are counted under an empty app.
+func (s *WatchStorage) AppCounts(from, to time.Time) ([]AppCount, error) {
+	rows, err := s.db.Query(`
+		select coalesce(window_class, ''), sum(nrkeys)
+		from keys
+		where `+createdBetween+`
+		group by 1
+		order by 2 desc, 1;
+	`, createdBetweenArgs(from, to)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	out := make([]AppCount, 0)
+	for rows.Next() {
+		var count AppCount
+		if err := rows.Scan(&count.App, &count.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, count)
+	}
+
+	return out, rows.Err()
+}
+
+var reportFuncs = map[string]interface{}{
+	"percent": func(change float64) string {
+		return fmt.Sprintf("%+.0f%%", change)
+	},
+	"duration": func(minutes int64) string {
+		return fmt.Sprintf("%dh %02dm", minutes/60, minutes%60)
+	},
+	"clock": func(t time.Time) string {
+		return t.Format("Mon 2006-01-02 15:04")
+	},
+	"hour": func(hour int) string {
+		return fmt.Sprintf("%02d:00", hour)
+	},
+	"app": func(app string) string {
+		if app == "" {
+			return "unknown"
+		}
+		return app
+	},
+	"weekday": func(day string) string {
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			return day
+		}
+		return t.Format("Mon 2006-01-02")
+	},
+	"streak": func(streak Streak) string {
+		if streak.Days == 0 {
+			return "0 days"
+		}
+		return fmt.Sprintf("%d days (%s to %s)", streak.Days, streak.Start, streak.End)
+	},
+	"sparkline": func(days []RangeCount) string {
+		return sparkline(days)
+	},
+}
+
+var reportTextTemplate = template.Must(template.New("text").Funcs(reportFuncs).Parse(
+	`selfwatch report: {{.Title}} ({{.Start.Format "2006-01-02"}} to {{.LastDay}})
+
+Total keys:      {{.Total}} ({{percent .Change}} from {{.PreviousTotal}})
+Active time:     {{duration .ActiveMinutes}}
+Daily activity:  {{sparkline .Days}}
+
+Busiest days
+{{range .BusiestDays}}  {{weekday .Bucket}}	{{.Count}}
+{{else}}  none
+{{end}}
+Busiest hours
+{{range .BusiestHours}}  {{hour .Hour}}	{{.Count}}
+{{else}}  none
+{{end}}
+Top applications
+{{range .TopApps}}  {{app .App}}	{{.Count}}
+{{else}}  none
+{{end}}
+Sessions
+  count:	{{.Sessions}}
+  total:	{{duration .SessionMinutes}}
+{{with .LongestSession}}  longest:	{{duration .Minutes}} ({{clock .Start}}, {{.Keys}} keys)
+{{end}}
+Streaks
+  current:	{{streak .CurrentStreak}}
+  longest:	{{streak .LongestStreak}}
+`))
+
+var reportMarkdownTemplate = template.Must(template.New("markdown").Funcs(reportFuncs).Parse(
+	`# selfwatch report: {{.Title}}
+
+{{.Start.Format "2006-01-02"}} to {{.LastDay}}
+
+* **Total keys:** {{.Total}} ({{percent .Change}} from {{.PreviousTotal}})
+* **Active time:** {{duration .ActiveMinutes}}
+* **Daily activity:** ` + "`{{sparkline .Days}}`" + `
+
+## Busiest days
+
+| Day | Keys |
+| --- | ---: |
+{{range .BusiestDays}}| {{weekday .Bucket}} | {{.Count}} |
+{{end}}
+## Busiest hours
+
+| Hour | Keys |
+| --- | ---: |
+{{range .BusiestHours}}| {{hour .Hour}} | {{.Count}} |
+{{end}}
+## Top applications
+
+| Application | Keys |
+| --- | ---: |
+{{range .TopApps}}| {{app .App}} | {{.Count}} |
+{{end}}
+## Sessions
+
+* **Sessions:** {{.Sessions}}
+* **Total:** {{duration .SessionMinutes}}
+{{with .LongestSession}}* **Longest:** {{duration .Minutes}} ({{clock .Start}}, {{.Keys}} keys)
+{{end}}
+## Streaks
+
+* **Current:** {{streak .CurrentStreak}}
+* **Longest:** {{streak .LongestStreak}}
+`))
+
+var reportHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Funcs(reportFuncs).Funcs(htmltemplate.FuncMap{
+	"chart": func(days []RangeCount) (htmltemplate.HTML, error) {
+		bars := make([]ChartBar, 0, len(days))
+		for _, day := range days {
+			label := day.Bucket
+			if t, err := time.Parse("2006-01-02", day.Bucket); err == nil {
+				// weekdays for a week, days of the month for a month
+				label = t.Format("2")
+				if len(days) <= 7 {
+					label = t.Format("Mon")
+				}
+			}
+			bars = append(bars, ChartBar{Label: label, Title: day.Bucket, Count: day.Count})
+		}
+
+		var out strings.Builder
+		err := RenderBarChart(&out, bars, 720, SVGThemes["light"])
+		return htmltemplate.HTML(out.String()), err
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>selfwatch report: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 720px; margin: 2em auto; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { padding: 2px 12px 2px 0; text-align: left; }
+td.count { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Start.Format "2006-01-02"}} to {{.LastDay}}</p>
+<p><strong>{{.Total}}</strong> keys ({{percent .Change}} from {{.PreviousTotal}}), {{duration .ActiveMinutes}} active</p>
+{{chart .Days}}
+<h2>Busiest days</h2>
+<table>{{range .BusiestDays}}<tr><td>{{weekday .Bucket}}</td><td class="count">{{.Count}}</td></tr>{{end}}</table>
+<h2>Busiest hours</h2>
+<table>{{range .BusiestHours}}<tr><td>{{hour .Hour}}</td><td class="count">{{.Count}}</td></tr>{{end}}</table>
+<h2>Top applications</h2>
+<table>{{range .TopApps}}<tr><td>{{app .App}}</td><td class="count">{{.Count}}</td></tr>{{end}}</table>
+<h2>Sessions</h2>
+<p>{{.Sessions}} sessions, {{duration .SessionMinutes}} in total.{{with .LongestSession}} The longest was {{duration .Minutes}} on {{clock .Start}} with {{.Keys}} keys.{{end}}</p>
+<h2>Streaks</h2>
+<p>Current: {{streak .CurrentStreak}}<br>Longest: {{streak .LongestStreak}}</p>
+</body>
+</html>
+`))
+
+// Write writes the report in the given format
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "", ReportFormatText:
+		return reportTextTemplate.Execute(w, r)
+	case ReportFormatMarkdown:
+		return reportMarkdownTemplate.Execute(w, r)
+	case ReportFormatHTML:
+		return reportHTMLTemplate.Execute(w, r)
+	}
+	return fmt.Errorf("invalid report format: %s", format)
+}
+
+var sparklineBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws counts as a line of block characters
+func sparkline(counts []RangeCount) string {
+	var max int64
+	for _, count := range counts {
+		if count.Count > max {
+			max = count.Count
+		}
+	}
+
+	var out strings.Builder
+	for _, count := range counts {
+		level := 0
+		if max > 0 {
+			level = int(count.Count * int64(len(sparklineBlocks)-1) / max)
+		}
+		out.WriteRune(sparklineBlocks[level])
+	}
+	return out.String()
+}
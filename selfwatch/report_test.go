@@ -0,0 +1,142 @@
+package selfwatch
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportRange(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+
+	from, to, err := ReportRange(BucketWeek, now, 4, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !from.Equal(time.Date(2024, 2, 26, 4, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2024, 3, 4, 4, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected week %v to %v", from, to)
+	}
+
+	from, to, err = ReportRange(BucketMonth, now, 4, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !from.Equal(time.Date(2024, 3, 1, 4, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2024, 4, 1, 4, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected month %v to %v", from, to)
+	}
+
+	if _, _, err := ReportRange("day", now, 4, 0); err == nil {
+		t.Fatal("Expected an error for an invalid period")
+	}
+}
+
+func TestReport(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	rows := []struct {
+		createdAt string
+		keys      int
+		app       string
+	}{
+		// the week before
+		{"2024-02-28 10:00:00", 1000, "kitty"},
+		// a session from 10:00 to 10:03
+		{"2024-03-04 10:00:00", 500, "kitty"},
+		{"2024-03-04 10:02:00", 700, "kitty"},
+		{"2024-03-04 10:02:30", 300, "Firefox"},
+		// a separate session after being idle
+		{"2024-03-04 11:00:00", 200, "Firefox"},
+		{"2024-03-06 15:00:00", 800, ""},
+	}
+
+	for _, row := range rows {
+		_, err := storage.db.Exec(`insert into keys(created_at, nrkeys, window_class) values(?, ?, nullif(?, ''))`,
+			row.createdAt, row.keys, row.app)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	from := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	report, err := storage.Report(BucketWeek, from, from.AddDate(0, 0, 7), 0, 5*time.Minute, 1000)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if report.Total != 2500 || report.PreviousTotal != 1000 || report.Change() != 150 {
+		t.Fatalf("Unexpected totals %d, %d", report.Total, report.PreviousTotal)
+	}
+
+	if len(report.Days) != 7 || report.Days[2] != (RangeCount{"2024-03-06", 800}) {
+		t.Fatalf("Unexpected days %+v", report.Days)
+	}
+
+	if report.BusiestDays[0] != (RangeCount{"2024-03-04", 1700}) || report.BusiestHours[0] != (HourOfDayCount{10, 1500}) {
+		t.Fatalf("Unexpected busiest %+v %+v", report.BusiestDays, report.BusiestHours)
+	}
+
+	if report.TopApps[0] != (AppCount{"kitty", 1200}) || report.TopApps[1] != (AppCount{"", 800}) {
+		t.Fatalf("Unexpected top apps %+v", report.TopApps)
+	}
+
+	if report.Sessions != 3 || report.SessionMinutes != 5 || report.LongestSession.Minutes != 3 || report.LongestSession.Keys != 1500 {
+		t.Fatalf("Unexpected sessions %d, %d, %+v", report.Sessions, report.SessionMinutes, report.LongestSession)
+	}
+
+	if report.LongestStreak.Days != 1 {
+		t.Fatalf("Unexpected longest streak %+v", report.LongestStreak)
+	}
+
+	expected := map[string]string{
+		ReportFormatText:     "Total keys:      2500 (+150% from 1000)",
+		ReportFormatMarkdown: "| Mon 2024-03-04 | 1700 |",
+		ReportFormatHTML:     "<svg",
+	}
+
+	for format, line := range expected {
+		var out bytes.Buffer
+		if err := report.Write(&out, format); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("Expected %s report to contain %q, got:\n%s", format, line, out.String())
+		}
+	}
+}
+
+func TestReportPreviousPeriodDST(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	// the week before clocks went forward in New York, starting at 4:00 EST,
+	// and keys at 3:30 EST which belong to the week before it
+	for _, row := range []struct {
+		createdAt string
+		keys      int
+	}{
+		{"2024-03-04 08:30:00", 100},
+		{"2024-03-04 09:30:00", 200},
+	} {
+		_, err := storage.db.Exec(`insert into keys(created_at, nrkeys) values(?, ?)`, row.createdAt, row.keys)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	now := time.Date(2024, 3, 13, 12, 0, 0, 0, mustLoadLocation("America/New_York"))
+	from, to, err := ReportRange(BucketWeek, now, 4, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err := storage.Report(BucketWeek, from, to, 4, 5*time.Minute, 1000)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if report.PreviousTotal != 200 {
+		t.Fatalf("Expected a previous total of 200, got %d", report.PreviousTotal)
+	}
+}
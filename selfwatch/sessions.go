@@ -0,0 +1,90 @@
+package selfwatch
+
+import (
+	"sort"
+	"time"
+)
+
+// sessionTracker follows continuous activity. A session ends once no input
+// has been seen for longer than idle.
+type sessionTracker struct {
+	idle  time.Duration
+	start time.Time
+	last  time.Time
+}
+
+func newSessionTracker(idle time.Duration) *sessionTracker {
+	return &sessionTracker{idle: idle}
+}
+
+// activity records input at now, returning true if it started a new session
+func (t *sessionTracker) activity(now time.Time) bool {
+	started := !t.active(now)
+	if started {
+		t.start = now
+	}
+	t.last = now
+	return started
+}
+
+func (t *sessionTracker) active(now time.Time) bool {
+	return !t.last.IsZero() && now.Sub(t.last) <= t.idle
+}
+
+// length returns how long the current session has lasted, 0 if idle
+func (t *sessionTracker) length(now time.Time) time.Duration {
+	if !t.active(now) {
+		return 0
+	}
+	return t.last.Sub(t.start)
+}
+
+// activeMinute is a minute with keys, labeled with what they were typed into
+type activeMinute struct {
+	time  time.Time
+	keys  int64
+	label string
+}
+
+// minuteSession is a run of active minutes with the same label, ending at
+// the end of its last minute
+type minuteSession struct {
+	label      string
+	start, end time.Time
+	keys       int64
+	day        string
+}
+
+// groupSessions groups minutes into sessions, in loc. A session ends after
+// idle without keys, when a minute has another label, or when a new day
+// starts at newDayHour.
+func groupSessions(minutes []activeMinute, idle time.Duration, newDayHour int, loc *time.Location) []minuteSession {
+	sort.Slice(minutes, func(i, j int) bool {
+		return minutes[i].time.Before(minutes[j].time)
+	})
+
+	out := make([]minuteSession, 0)
+	for _, minute := range minutes {
+		start := minute.time.In(loc)
+		day := bucketKey(start, BucketDay, newDayHour)
+
+		if n := len(out); n > 0 {
+			session := &out[n-1]
+			if session.label == minute.label && session.day == day && start.Sub(session.end) <= idle {
+				session.end = start.Add(time.Minute)
+				session.keys += minute.keys
+				continue
+			}
+		}
+
+		out = append(out, minuteSession{
+			label: minute.label,
+			start: start,
+			end:   start.Add(time.Minute),
+			keys:  minute.keys,
+			day:   day,
+		})
+	}
+
+	return out
+}
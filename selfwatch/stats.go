@@ -0,0 +1,150 @@
+package selfwatch
+
+import (
+	"sort"
+	"time"
+)
+
+type Streak struct {
+	Days  int    `json:"days"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+type BestPeriod struct {
+	Period string `json:"period"`
+	Count  int64  `json:"count"`
+}
+
+type WeekdayAverage struct {
+	Weekday string  `json:"weekday"`
+	Average float64 `json:"average"`
+}
+
+type YearTotal struct {
+	Year  string `json:"year"`
+	Count int64  `json:"count"`
+}
+
+type Stats struct {
+	Threshold     int64  `json:"threshold"`
+	CurrentStreak Streak `json:"currentStreak"`
+	LongestStreak Streak `json:"longestStreak"`
+
+	BestDay  *BestPeriod `json:"bestDay"`
+	BestHour *BestPeriod `json:"bestHour"`
+	BestWeek *BestPeriod `json:"bestWeek"`
+
+	// averages include days without any activity, from the first recorded day
+	WeekdayAverages []WeekdayAverage `json:"weekdayAverages"`
+	YearTotals      []YearTotal      `json:"yearTotals"`
+}
+
+// Stats computes records over the whole history. A day counts towards a
+// streak when it has at least threshold keys. The current streak is still
+// alive if today hasn't reached the threshold yet but yesterday did.
+func (c keyCounts) Stats(threshold int64, newDayHour int, now time.Time) (*Stats, error) {
+	loc := now.Location()
+
+	counts, err := c.hourCounts(time.Unix(0, 0), now.Add(time.Minute), loc)
+	if err != nil {
+		return nil, err
+	}
+
+	days := make(map[string]int64)
+	hours := make(map[string]int64)
+	weeks := make(map[string]int64)
+	years := make(map[string]int64)
+
+	for start, count := range counts {
+		local := start.In(loc)
+		days[bucketKey(local, BucketDay, newDayHour)] += count
+		hours[bucketKey(local, BucketHour, newDayHour)] += count
+		weeks[bucketKey(local, BucketWeek, newDayHour)] += count
+		years[bucketKey(local, BucketYear, newDayHour)] += count
+	}
+
+	stats := &Stats{
+		Threshold:       threshold,
+		BestDay:         bestPeriod(days),
+		BestHour:        bestPeriod(hours),
+		BestWeek:        bestPeriod(weeks),
+		WeekdayAverages: make([]WeekdayAverage, 0),
+		YearTotals:      make([]YearTotal, 0),
+	}
+
+	for year, count := range years {
+		stats.YearTotals = append(stats.YearTotals, YearTotal{Year: year, Count: count})
+	}
+	sort.Slice(stats.YearTotals, func(i, j int) bool {
+		return stats.YearTotals[i].Year < stats.YearTotals[j].Year
+	})
+
+	if len(days) == 0 {
+		return stats, nil
+	}
+
+	start := LogicalDayStart(now, newDayHour)
+	today := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	first := today
+	for day := range days {
+		if parsed, err := time.ParseInLocation("2006-01-02", day, loc); err == nil && parsed.Before(first) {
+			first = parsed
+		}
+	}
+
+	var weekdayTotals [7]int64
+	var weekdayDays [7]int
+
+	var current Streak
+	for day := first; !day.After(today); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		count := days[key]
+
+		weekdayTotals[day.Weekday()] += count
+		weekdayDays[day.Weekday()] += 1
+
+		if count >= threshold && threshold > 0 {
+			if current.Days == 0 {
+				current.Start = key
+			}
+			current.Days += 1
+			current.End = key
+
+			if current.Days > stats.LongestStreak.Days {
+				stats.LongestStreak = current
+			}
+		} else if !day.Equal(today) {
+			current = Streak{}
+		}
+	}
+
+	stats.CurrentStreak = current
+
+	// list weekdays starting on Monday
+	for i := 1; i <= 7; i++ {
+		weekday := time.Weekday(i % 7)
+		average := 0.0
+		if weekdayDays[weekday] > 0 {
+			average = float64(weekdayTotals[weekday]) / float64(weekdayDays[weekday])
+		}
+		stats.WeekdayAverages = append(stats.WeekdayAverages, WeekdayAverage{
+			Weekday: weekday.String()[:3],
+			Average: average,
+		})
+	}
+
+	return stats, nil
+}
+
+// bestPeriod returns the period with the highest count, the earliest one on
+// ties. Returns nil if there are no periods.
+func bestPeriod(counts map[string]int64) *BestPeriod {
+	var best *BestPeriod
+	for period, count := range counts {
+		if best == nil || count > best.Count || (count == best.Count && period < best.Period) {
+			best = &BestPeriod{Period: period, Count: count}
+		}
+	}
+	return best
+}
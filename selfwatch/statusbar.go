@@ -0,0 +1,189 @@
+package selfwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Output formats accepted by NewStatusFormatter, any other format containing
+// {{ is treated as a Go template
+const (
+	StatusFormatText     = "text"
+	StatusFormatJSON     = "json"
+	StatusFormatI3bar    = "i3bar"
+	StatusFormatI3blocks = "i3blocks"
+	StatusFormatWaybar   = "waybar"
+	StatusFormatPolybar  = "polybar"
+)
+
+// colors used by the status bar formats for being ahead of or behind
+// yesterday
+const (
+	statusColorAhead  = "#a6e22e"
+	statusColorBehind = "#f92672"
+)
+
+// Status is the summary shown by selfwatch status
+type Status struct {
+	Time      time.Time `json:"time"`
+	Today     int64     `json:"today"`
+	Yesterday int64     `json:"yesterday"`
+	Delta     int64     `json:"delta"`
+}
+
+// Text formats the status as today's count with the difference from
+// yesterday, eg. 1200 (+200)
+func (s Status) Text() string {
+	return fmt.Sprintf("%d (%s)", s.Today, s.DeltaText())
+}
+
+func (s Status) DeltaText() string {
+	if s.Delta >= 0 {
+		return fmt.Sprintf("+%d", s.Delta)
+	}
+	return fmt.Sprintf("%d", s.Delta)
+}
+
+// Ahead is true if there have been at least as many keys today as yesterday
+func (s Status) Ahead() bool {
+	return s.Delta >= 0
+}
+
+func (s Status) class() string {
+	if s.Ahead() {
+		return "ahead"
+	}
+	return "behind"
+}
+
+func (s Status) color() string {
+	if s.Ahead() {
+		return statusColorAhead
+	}
+	return statusColorBehind
+}
+
+// Status counts the keys for the day containing now and the whole day before
+func (s *WatchStorage) Status(newDayHour int, now time.Time) (*Status, error) {
+	todayStart := LogicalDayStart(now, newDayHour)
+	yesterdayStart := todayStart.AddDate(0, 0, -1)
+
+	today, err := s.TotalCount(todayStart, todayStart.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	yesterday, err := s.TotalCount(yesterdayStart, todayStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Status{
+		Time:      now,
+		Today:     today,
+		Yesterday: yesterday,
+		Delta:     today - yesterday,
+	}, nil
+}
+
+// StatusFormatter writes statuses in one of the status bar formats
+type StatusFormatter struct {
+	format string
+	tmpl   *template.Template
+}
+
+func NewStatusFormatter(format string) (*StatusFormatter, error) {
+	switch format {
+	case "":
+		return &StatusFormatter{format: StatusFormatText}, nil
+	case StatusFormatText, StatusFormatJSON, StatusFormatI3bar, StatusFormatI3blocks,
+		StatusFormatWaybar, StatusFormatPolybar:
+		return &StatusFormatter{format: format}, nil
+	}
+
+	if !strings.Contains(format, "{{") {
+		return nil, fmt.Errorf("invalid status format: %s", format)
+	}
+
+	tmpl, err := template.New("status").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatusFormatter{tmpl: tmpl}, nil
+}
+
+// Begin writes the header needed before a stream of statuses. Only the
+// i3bar protocol has one.
+func (f *StatusFormatter) Begin(w io.Writer) error {
+	if f.format != StatusFormatI3bar {
+		return nil
+	}
+	_, err := io.WriteString(w, "{\"version\":1}\n[\n")
+	return err
+}
+
+// Write writes status as a single line. When watching, i3bar statuses are
+// elements of an endless array so they are separated with commas.
+func (f *StatusFormatter) Write(w io.Writer, status *Status, watching bool) error {
+	line, err := f.render(status)
+	if err != nil {
+		return err
+	}
+
+	if f.format == StatusFormatI3bar {
+		line = "[" + line + "]"
+		if watching {
+			line += ","
+		}
+	}
+
+	_, err = io.WriteString(w, line+"\n")
+	return err
+}
+
+func (f *StatusFormatter) render(status *Status) (string, error) {
+	if f.tmpl != nil {
+		var buffer bytes.Buffer
+		if err := f.tmpl.Execute(&buffer, status); err != nil {
+			return "", err
+		}
+		return buffer.String(), nil
+	}
+
+	switch f.format {
+	case StatusFormatJSON:
+		return marshalStatusLine(status)
+	case StatusFormatI3bar, StatusFormatI3blocks:
+		return marshalStatusLine(map[string]string{
+			"name":       "selfwatch",
+			"full_text":  status.Text(),
+			"short_text": fmt.Sprintf("%d", status.Today),
+			"color":      status.color(),
+		})
+	case StatusFormatWaybar:
+		return marshalStatusLine(map[string]string{
+			"text":    status.Text(),
+			"tooltip": fmt.Sprintf("Today: %d keys\nYesterday: %d keys", status.Today, status.Yesterday),
+			"class":   status.class(),
+			"alt":     status.class(),
+		})
+	case StatusFormatPolybar:
+		return fmt.Sprintf("%d (%%{F%s}%s%%{F-})", status.Today, status.color(), status.DeltaText()), nil
+	default:
+		return status.Text(), nil
+	}
+}
+
+func marshalStatusLine(v interface{}) (string, error) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
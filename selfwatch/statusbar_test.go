@@ -0,0 +1,85 @@
+package selfwatch
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStatusFormats(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	rows := []struct {
+		createdAt string
+		keys      int
+	}{
+		{"2024-03-02 10:00:00", 1200},
+		// before the new day hour, counted as the previous day
+		{"2024-03-02 03:00:00", 500},
+		{"2024-03-01 12:00:00", 1000},
+	}
+
+	for _, row := range rows {
+		_, err := storage.db.Exec(`insert into keys(created_at, nrkeys) values(?, ?)`, row.createdAt, row.keys)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	status, err := storage.Status(4, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if status.Today != 1200 || status.Yesterday != 1500 || status.Delta != -300 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	expected := []struct {
+		format string
+		output string
+	}{
+		{"", "1200 (-300)\n"},
+		{StatusFormatJSON, `{"time":"2024-03-02T12:00:00Z","today":1200,"yesterday":1500,"delta":-300}` + "\n"},
+		{StatusFormatI3blocks, `{"color":"#f92672","full_text":"1200 (-300)","name":"selfwatch","short_text":"1200"}` + "\n"},
+		{StatusFormatWaybar, `{"alt":"behind","class":"behind","text":"1200 (-300)","tooltip":"Today: 1200 keys\nYesterday: 1500 keys"}` + "\n"},
+		{StatusFormatPolybar, "1200 (%{F#f92672}-300%{F-})\n"},
+		{"{{.Today}} keys, {{.DeltaText}}", "1200 keys, -300\n"},
+	}
+
+	for _, e := range expected {
+		formatter, err := NewStatusFormatter(e.format)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		var out bytes.Buffer
+		if err := formatter.Write(&out, status, false); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if out.String() != e.output {
+			t.Fatalf("Format %q: expected %q, got %q", e.format, e.output, out.String())
+		}
+	}
+
+	// the i3bar protocol is a header followed by an endless array
+	formatter, err := NewStatusFormatter(StatusFormatI3bar)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var out bytes.Buffer
+	formatter.Begin(&out)
+	formatter.Write(&out, status, true)
+
+	block := `{"color":"#f92672","full_text":"1200 (-300)","name":"selfwatch","short_text":"1200"}`
+	if out.String() != "{\"version\":1}\n[\n["+block+"],\n" {
+		t.Fatalf("Unexpected i3bar output %q", out.String())
+	}
+
+	if _, err := NewStatusFormatter("xml"); err == nil {
+		t.Fatal("Expected an error for an unknown format")
+	}
+}
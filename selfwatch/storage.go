@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,18 +14,58 @@ var keysSchema = `
 CREATE TABLE keys (
 	id INTEGER NOT NULL,
 	created_at DATETIME,
+	utc_offset INTEGER,
 	nrkeys INTEGER,
+	window_class TEXT,
+	window_title TEXT,
+	project TEXT,
 	PRIMARY KEY (id)
 );
 CREATE INDEX ix_keys_nrkeys ON keys (nrkeys);
 CREATE INDEX ix_keys_created_at ON keys (created_at);
 `
 
+// WatchStorage is the SQLite backend for Storage
 type WatchStorage struct {
+	keyCounts
+
 	fname string
 	db    *sql.DB
+
+	flushListeners []func(FlushEvent)
+	projects       *ProjectRules
+	clock          Clock
+
+	// writes keys for BindRecorder
+	batch *BatchWriter
 }
 
+// FlushEvent describes a batch of key presses stored by BindRecorder, or
+// that failed to be stored. Rows that keep failing are only reported once.
+type FlushEvent struct {
+	// Time is when the last keys in the batch were typed
+	Time time.Time
+	Keys int
+	// App is the window class the keys were typed into, if they were all
+	// typed into the same one
+	App string
+	// Project is the project the window was classified as, if any
+	Project string
+	// Err is set if the write to the database failed
+	Err error
+}
+
+// The recorder and the web server usually open the same database from
+// separate processes. In WAL mode readers don't block the writer, the busy
+// timeout makes a connection wait for another's write instead of failing with
+// "database is locked", and immediate transactions take the write lock up
+// front so they can't deadlock upgrading a read.
+const connectionParams = "_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&_txlock=immediate"
+
+// connections kept open to the database, enough for the web server to answer
+// requests while a write is in progress
+const maxOpenConns = 4
+
 func NewWatchStorage(fname string) (*WatchStorage, error) {
 	expandedFname, err := expandHomePath(fname)
 	if err != nil {
@@ -32,16 +73,21 @@ func NewWatchStorage(fname string) (*WatchStorage, error) {
 	}
 	fname = expandedFname
 	log.Print("Loading database ", fname)
-	db, err := sql.Open("sqlite3", fname)
+	db, err := sql.Open("sqlite3", fname+"?"+connectionParams)
 
 	if err != nil {
 		return nil, err
 	}
 
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+
 	storage := &WatchStorage{
 		fname: fname,
 		db:    db,
+		clock: SystemClock,
 	}
+	storage.keyCounts = keyCounts{storage}
 
 	// Log last key press if available
 	if lastPress, lastId, err := storage.GetLastKeyPress(); err == nil && lastPress != nil {
@@ -85,6 +131,12 @@ func (s *WatchStorage) GetLastKeyPress() (*time.Time, int64, error) {
 	return &createdAt, id, nil
 }
 
+func (s *WatchStorage) TotalKeys() (int64, error) {
+	var total int64
+	err := s.db.QueryRow(`select coalesce(sum(nrkeys), 0) from keys`).Scan(&total)
+	return total, err
+}
+
 func (s *WatchStorage) CreateSchema() error {
 	_, err := s.db.Exec(keysSchema)
 	if err != nil {
@@ -93,6 +145,62 @@ func (s *WatchStorage) CreateSchema() error {
 	return nil
 }
 
+// columns added to keys since it was first created, migrate runs once when
+// the column is added
+var keysColumns = []struct{ name, definition, migrate string }{
+	{"window_class", "TEXT", ""},
+	{"window_title", "TEXT", ""},
+	{"project", "TEXT", ""},
+	{"utc_offset", "INTEGER", migrateUtcOffset},
+}
+
+// Rows used to be stored with the local time and offset they were recorded
+// at, eg. "2024-03-10 01:59:00.123-05:00". Convert them to UTC and keep the
+// offset. Rows received by sync are already in UTC without an offset.
+var migrateUtcOffset = `
+UPDATE keys SET
+	utc_offset = cast(round((julianday(substr(created_at, 1, 19)) - julianday(created_at)) * 86400) as integer),
+	created_at = datetime(created_at)
+WHERE length(created_at) > 19;
+`
+
+// UpdateSchema creates any tables and columns added since the database was
+// first created. It is safe to call on every start.
+func (s *WatchStorage) UpdateSchema() error {
+	for _, column := range keysColumns {
+		added, err := s.addColumn("keys", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+
+		if added && column.migrate != "" {
+			if _, err := s.db.Exec(column.migrate); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, schema := range []string{syncBlobsSchema, syncOutboxSchema, goalsSchema, breaksSchema, annotationsSchema} {
+		if _, err := s.db.Exec(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to table if it doesn't exist yet, returning true
+// if it was added
+func (s *WatchStorage) addColumn(table, name, definition string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`select count(*) > 0 from pragma_table_info(?) where name = ?`, table, name).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, name, definition))
+	return err == nil, err
+}
+
 func (s *WatchStorage) SchemaExists() (bool, error) {
 	rows, err := s.db.Query(`SELECT 1 FROM sqlite_master WHERE type='table' AND name='keys';`)
 	if err != nil {
@@ -106,32 +214,95 @@ func (s *WatchStorage) SchemaExists() (bool, error) {
 }
 
 func (s *WatchStorage) WriteKeys(keys int) error {
+	return s.WriteAppKeys(keys, "")
+}
+
+// WriteAppKeys stores keys typed into the application with the given window
+// class
+func (s *WatchStorage) WriteAppKeys(keys int, app string) error {
+	return s.WriteWindowKeys(keys, app, "", "")
+}
+
+// WriteWindowKeys stores keys typed into a window with the given class and
+// title, classified as project
+func (s *WatchStorage) WriteWindowKeys(keys int, app, title, project string) error {
+	_, err := s.db.Exec(insertKeysQuery, keyWrite{s.Now(), keys, app, title, project}.args()...)
+	return err
+}
+
+const insertKeysQuery = `insert into keys(created_at, utc_offset, nrkeys, window_class, window_title, project)
+	values(?, ?, ?, ?, ?, ?)`
+
+// recorderBatchSize is how many writes BindRecorder stores at once at most
+const recorderBatchSize = 100
+
+// keyWrite is a row of keys waiting to be inserted
+type keyWrite struct {
+	time    time.Time
+	keys    int
+	app     string
+	title   string
+	project string
+}
+
+// args returns the values for insertKeysQuery. Times are stored in UTC,
+// with the offset of the time zone they were recorded in.
+func (k keyWrite) args() []interface{} {
+	_, offset := k.time.Zone()
+	return []interface{}{
+		k.time.UTC().Format("2006-01-02 15:04:05"),
+		offset,
+		k.keys,
+		sql.NullString{String: k.app, Valid: k.app != ""},
+		sql.NullString{String: k.title, Valid: k.title != ""},
+		sql.NullString{String: k.project, Valid: k.project != ""},
+	}
+}
+
+// writeKeys inserts rows in a single transaction
+func (s *WatchStorage) writeKeys(writes []keyWrite) error {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	defer tx.Commit()
-
-	stmt, err := tx.Prepare("insert into keys(created_at, nrkeys) values(?, ?)")
-
+	stmt, err := tx.Prepare(insertKeysQuery)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(time.Now(), keys)
-	return err
+	for _, write := range writes {
+		if _, err = stmt.Exec(write.args()...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-type rowTuple struct {
-	id         int
-	created_at string
-	nrkeys     string
+// Close stores any keys waiting to be written by BindRecorder and closes the
+// database
+func (s *WatchStorage) Close() error {
+	if s.batch != nil {
+		if err := s.batch.Close(); err != nil {
+			log.Printf("Error writing keys: %v", err)
+		}
+	}
+	return s.db.Close()
 }
 
-func (s *WatchStorage) KeyCountsAfterId(id int64) ([]rowTuple, error) {
+// KeyRow is a single flush of key presses, as stored and as synced
+type KeyRow struct {
+	Id        int64  `json:"id"`
+	CreatedAt string `json:"created_at"`
+	NrKeys    int64  `json:"nrkeys"`
+}
+
+func (s *WatchStorage) KeyCountsAfterId(id int64) ([]KeyRow, error) {
 	rows, err := s.db.Query(`select
 			id,
 			strftime('%Y-%m-%d %H:%M:%S', created_at),
@@ -145,12 +316,12 @@ func (s *WatchStorage) KeyCountsAfterId(id int64) ([]rowTuple, error) {
 
 	defer rows.Close()
 
-	var out []rowTuple
+	var out []KeyRow
 
 	for rows.Next() {
-		var row rowTuple
+		var row KeyRow
 
-		err = rows.Scan(&row.id, &row.created_at, &row.nrkeys)
+		err = rows.Scan(&row.Id, &row.CreatedAt, &row.NrKeys)
 		if err != nil {
 			return nil, err
 		}
@@ -160,42 +331,135 @@ func (s *WatchStorage) KeyCountsAfterId(id int64) ([]rowTuple, error) {
 	return out, nil
 }
 
+// SerializeRecentKeyCounts returns rows after id in the legacy sync format
 func (s *WatchStorage) SerializeRecentKeyCounts(id int64) ([][]interface{}, error) {
-	tuples, err := s.KeyCountsAfterId(id)
+	rows, err := s.KeyCountsAfterId(id)
 	if err != nil {
 		return nil, err
 	}
 
-	var out [][]interface{}
+	return serializeLegacyRows(rows), nil
+}
+
+// InsertKeyRows stores rows received from another selfwatch instance,
+// keeping their original ids. Rows that already exist are skipped.
+func (s *WatchStorage) InsertKeyRows(rows []KeyRow) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("insert or ignore into keys(id, created_at, nrkeys) values(?, ?, ?)")
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err = stmt.Exec(row.Id, row.CreatedAt, row.NrKeys); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MaxSyncedRowId returns the highest row id received so far, either stored
+// as a row or as part of an encrypted chunk
+func (s *WatchStorage) MaxSyncedRowId() (int64, error) {
+	var maxId int64
+	err := s.db.QueryRow(`select max(
+		coalesce((select max(id) from keys), 0),
+		coalesce((select max(last_row_id) from sync_blobs), 0)
+	)`).Scan(&maxId)
+	return maxId, err
+}
+
+func (s *WatchStorage) InsertSyncBlob(lastRowId int64, payload []byte) error {
+	_, err := s.db.Exec("insert into sync_blobs(created_at, last_row_id, payload) values(?, ?, ?)",
+		s.Now(), lastRowId, payload)
+	return err
+}
+
+func (s *WatchStorage) SyncBlobsAfter(lastRowId int64, limit int) ([]SyncBlob, error) {
+	rows, err := s.db.Query(`select last_row_id, payload
+		from sync_blobs where last_row_id > ?
+		order by last_row_id asc limit ?`, lastRowId, limit)
 
-	for _, tup := range tuples {
-		var flat []interface{}
-		flat = append(flat, tup.id)
-		flat = append(flat, tup.created_at)
-		flat = append(flat, tup.nrkeys)
-		out = append(out, flat)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	out := make([]SyncBlob, 0)
+
+	for rows.Next() {
+		var blob SyncBlob
+		if err = rows.Scan(&blob.LastRowId, &blob.Payload); err != nil {
+			return nil, err
+		}
+		out = append(out, blob)
 	}
 
 	return out, nil
 }
 
+// OnFlush registers a function called after every write made by
+// BindRecorder. Listeners are called from the goroutine storing the writes,
+// so they must not block.
+func (s *WatchStorage) OnFlush(fn func(FlushEvent)) {
+	s.flushListeners = append(s.flushListeners, fn)
+}
+
+// notifyFlush sends a single FlushEvent for rows written together
+func (s *WatchStorage) notifyFlush(rows []keyWrite, err error) {
+	flush := FlushEvent{App: rows[0].app, Project: rows[0].project, Err: err}
+	for _, row := range rows {
+		flush.Time = row.time
+		flush.Keys += row.keys
+		if row.app != flush.App || row.project != flush.Project {
+			flush.App, flush.Project = "", ""
+		}
+	}
+
+	for _, listener := range s.flushListeners {
+		listener(flush)
+	}
+}
+
+// BindRecorder counts keys from recorder, writing them every syncDelay
+// seconds or when the focused window changes. Writes are stored in batches
+// in the background so the recorder is never held up by the database, call
+// Close to store the last ones.
 func (s *WatchStorage) BindRecorder(recorder *Recorder, syncDelay float64) error {
+	s.batch = s.NewBatchWriter(recorderBatchSize, time.Second)
+	s.batch.written = s.notifyFlush
+
 	counter := 0
 	last := time.Unix(0, 0)
 	var lastWindow int64
 
 	recorder.KeyRelease = func(event Event) {
 		counter += 1
-		if time.Now().Sub(last).Seconds() > syncDelay || event.Window != lastWindow {
+		if s.Now().Sub(last).Seconds() > syncDelay || event.Window != lastWindow {
 			if counter > 0 {
 				log.Println("Syncing keys...", counter)
-				if err := s.WriteKeys(counter); err != nil {
+				app := recorder.WindowClass(lastWindow)
+				title := recorder.WindowTitle(lastWindow)
+				project := s.projects.Classify(app, title)
+				if err := s.batch.WriteWindowKeys(counter, app, title, project); err != nil {
 					log.Printf("Error writing keys: %v", err)
 				}
+
 				counter = 0
 			}
 
-			last = time.Now()
+			last = s.Now()
 			lastWindow = event.Window
 		}
 	}
@@ -219,169 +483,72 @@ type WeeklyHourlyCount struct {
 	Count int64  `json:"count"`
 }
 
-func (s *WatchStorage) DailyCounts(days int, newDayHour int) ([]DailyCount, error) {
-	rows, err := s.db.Query(`
-		select strftime('%Y-%m-%d',
-			datetime(datetime(created_at, 'localtime'), ?)
-		), sum(nrkeys)
-		from keys where created_at > datetime('now', ?)
-		group by 1;
-	`, fmt.Sprintf("-%v hours", newDayHour), fmt.Sprintf("-%v days", days))
-
+// DailyCounts sums keys by day for the days before now, in now's location
+func (c keyCounts) DailyCounts(days int, newDayHour int, now time.Time) ([]DailyCount, error) {
+	counts, err := c.RangeCounts(now.AddDate(0, 0, -days), now.Add(time.Minute), BucketDay, now.Location(), newDayHour)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([]DailyCount, 0)
-
-	defer rows.Close()
-	for rows.Next() {
-		var day string
-		var count int64
-
-		err = rows.Scan(&day, &count)
-
-		if err != nil {
-			return nil, err
-		}
-
-		out = append(out, DailyCount{
-			day, count,
-		})
+	out := make([]DailyCount, 0, len(counts))
+	for _, count := range counts {
+		out = append(out, DailyCount{count.Bucket, count.Count})
 	}
 
 	return out, nil
 }
 
-func (s *WatchStorage) HourlyCounts(hours int, dayOffset int) ([]HourlyCount, error) {
+// HourlyCounts sums keys by hour for the hours before now, in now's location
+func (c keyCounts) HourlyCounts(hours int, dayOffset int, now time.Time) ([]HourlyCount, error) {
 	// dayOffset: 0 = current period, 1 = previous 24h, etc.
-	startHours := hours + (dayOffset * 24)
-
-	var rows *sql.Rows
-	var err error
+	to := now.Add(time.Duration(-dayOffset*24) * time.Hour)
+	from := to.Add(time.Duration(-hours) * time.Hour)
 
 	if dayOffset == 0 {
-		// Current period: no upper bound needed
-		rows, err = s.db.Query(`
-			select strftime('%Y-%m-%d %H',
-				datetime(created_at, 'localtime')
-			), sum(nrkeys)
-			from keys
-			where created_at > datetime('now', 'localtime', ?)
-			group by 1
-			order by 1;
-		`, fmt.Sprintf("-%v hours", startHours))
-	} else {
-		// Historical period: need both bounds
-		endHours := dayOffset * 24
-		rows, err = s.db.Query(`
-			select strftime('%Y-%m-%d %H',
-				datetime(created_at, 'localtime')
-			), sum(nrkeys)
-			from keys
-			where created_at > datetime('now', 'localtime', ?)
-			  and created_at <= datetime('now', 'localtime', ?)
-			group by 1
-			order by 1;
-		`, fmt.Sprintf("-%v hours", startHours), fmt.Sprintf("-%v hours", endHours))
+		// Current period: include everything up to now
+		to = now.Add(time.Minute)
 	}
 
+	return c.hourlyCounts(from, to, now.Location())
+}
+
+// HourlyCountsForDate sums keys by hour for a YYYY-MM-DD date in loc, from
+// midnight to midnight
+func (c keyCounts) HourlyCountsForDate(date string, loc *time.Location) ([]HourlyCount, error) {
+	day, err := time.ParseInLocation("2006-01-02", date, loc)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([]HourlyCount, 0)
-
-	defer rows.Close()
-	for rows.Next() {
-		var hour string
-		var count int64
-
-		err = rows.Scan(&hour, &count)
-
-		if err != nil {
-			return nil, err
-		}
-
-		out = append(out, HourlyCount{
-			hour, count,
-		})
-	}
-
-	return out, nil
+	return c.hourlyCounts(day, day.AddDate(0, 0, 1), loc)
 }
 
-func (s *WatchStorage) HourlyCountsForDate(date string) ([]HourlyCount, error) {
-	// date format: "2024-12-10"
-	rows, err := s.db.Query(`
-		select strftime('%Y-%m-%d %H',
-			datetime(created_at, 'localtime')
-		), sum(nrkeys)
-		from keys
-		where date(created_at, 'localtime') = ?
-		group by 1
-		order by 1;
-	`, date)
-
+func (c keyCounts) hourlyCounts(from, to time.Time, loc *time.Location) ([]HourlyCount, error) {
+	counts, err := c.RangeCounts(from, to, BucketHour, loc, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([]HourlyCount, 0)
-
-	defer rows.Close()
-	for rows.Next() {
-		var hour string
-		var count int64
-
-		err = rows.Scan(&hour, &count)
-
-		if err != nil {
-			return nil, err
-		}
-
-		out = append(out, HourlyCount{
-			hour, count,
-		})
+	out := make([]HourlyCount, 0, len(counts))
+	for _, count := range counts {
+		out = append(out, HourlyCount{count.Bucket, count.Count})
 	}
 
 	return out, nil
 }
 
-func (s *WatchStorage) YearlyCounts(year int, newDayHour int) ([]DailyCount, error) {
-	startDate := fmt.Sprintf("%d-01-01", year)
-	endDate := fmt.Sprintf("%d-12-31", year)
-
-	rows, err := s.db.Query(`
-		select strftime('%Y-%m-%d',
-			datetime(datetime(created_at, 'localtime'), ?)
-		), sum(nrkeys)
-		from keys
-		where date(datetime(created_at, 'localtime'), ?) between ? and ?
-		group by 1
-		order by 1;
-	`, fmt.Sprintf("-%v hours", newDayHour), fmt.Sprintf("-%v hours", newDayHour), startDate, endDate)
+// YearlyCounts sums keys by day for every day of year in loc
+func (c keyCounts) YearlyCounts(year int, newDayHour int, loc *time.Location) ([]DailyCount, error) {
+	start := time.Date(year, 1, 1, newDayHour, 0, 0, 0, loc)
 
+	counts, err := c.RangeCounts(start, start.AddDate(1, 0, 0), BucketDay, loc, newDayHour)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([]DailyCount, 0)
-
-	defer rows.Close()
-	for rows.Next() {
-		var day string
-		var count int64
-
-		err = rows.Scan(&day, &count)
-
-		if err != nil {
-			return nil, err
-		}
-
-		out = append(out, DailyCount{
-			day, count,
-		})
+	out := make([]DailyCount, 0, len(counts))
+	for _, count := range counts {
+		out = append(out, DailyCount{count.Bucket, count.Count})
 	}
 
 	return out, nil
@@ -393,47 +560,45 @@ type WeeklyHeatmapResponse struct {
 	Data      []WeeklyHourlyCount `json:"data"`
 }
 
-func (s *WatchStorage) WeeklyHourlyGrid() (*WeeklyHeatmapResponse, error) {
-	now := time.Now()
+// WeeklyHourlyGrid sums keys by day and hour of the day for the last week,
+// in now's location
+func (c keyCounts) WeeklyHourlyGrid(now time.Time) (*WeeklyHeatmapResponse, error) {
+	loc := now.Location()
 	endDate := now.Format("2006-01-02")
 	startDate := now.AddDate(0, 0, -6).Format("2006-01-02")
 
-	rows, err := s.db.Query(`
-		select
-			strftime('%Y-%m-%d', datetime(created_at, 'localtime')) as day,
-			cast(strftime('%H', datetime(created_at, 'localtime')) as integer) as hour,
-			sum(nrkeys)
-		from keys
-		where created_at > datetime('now', '-7 days')
-		group by 1, 2
-		order by 1, 2;
-	`)
-
+	counts, err := c.hourCounts(now.AddDate(0, 0, -7), now.Add(time.Minute), loc)
 	if err != nil {
 		return nil, err
 	}
 
-	data := make([]WeeklyHourlyCount, 0)
-
-	defer rows.Close()
-	for rows.Next() {
-		var day string
-		var hour int
-		var count int64
-
-		err = rows.Scan(&day, &hour, &count)
+	type dayHour struct {
+		day  string
+		hour int
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	sums := make(map[dayHour]int64)
+	for start, count := range counts {
+		local := start.In(loc)
+		sums[dayHour{local.Format("2006-01-02"), local.Hour()}] += count
+	}
 
+	data := make([]WeeklyHourlyCount, 0, len(sums))
+	for key, count := range sums {
 		data = append(data, WeeklyHourlyCount{
-			Day:   day,
-			Hour:  hour,
+			Day:   key.day,
+			Hour:  key.hour,
 			Count: count,
 		})
 	}
 
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].Day != data[j].Day {
+			return data[i].Day < data[j].Day
+		}
+		return data[i].Hour < data[j].Hour
+	})
+
 	return &WeeklyHeatmapResponse{
 		StartDate: startDate,
 		EndDate:   endDate,
@@ -1,14 +1,25 @@
 package selfwatch
 
 import (
+	"database/sql"
 	"os"
+	"reflect"
 	"testing"
+	"time"
+	_ "time/tzdata"
 )
 
 const testDbName = "test.db"
 
+// removeDb deletes a test database along with its WAL files
+func removeDb(fname string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(fname + suffix)
+	}
+}
+
 func cleanDb() {
-	os.Remove(testDbName)
+	removeDb(testDbName)
 }
 
 func TestNewStorage(t *testing.T) {
@@ -85,6 +96,7 @@ func TestInsertKeys(t *testing.T) {
 
 	var count int
 	err = rows.Scan(&count)
+	rows.Close()
 
 	if err != nil {
 		t.Fatal(err.Error())
@@ -94,4 +106,535 @@ func TestInsertKeys(t *testing.T) {
 		t.Fatal("Expected three rows")
 	}
 
+	// keys are stored at the clock's time, in UTC with the offset they were
+	// recorded at
+	storage.SetClock(ClockFunc(func() time.Time {
+		return time.Date(2024, 3, 10, 1, 30, 15, 0, time.FixedZone("EST", -5*60*60))
+	}))
+
+	if err = storage.WriteAppKeys(9, "kitty"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var createdAt, app string
+	var keys, offset int
+	err = storage.db.QueryRow(`select cast(created_at as text), nrkeys, window_class, utc_offset
+		from keys order by id desc limit 1`).Scan(&createdAt, &keys, &app, &offset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if createdAt != "2024-03-10 06:30:15" || keys != 9 || app != "kitty" || offset != -5*60*60 {
+		t.Fatalf("Unexpected row %s %d %s %d", createdAt, keys, app, offset)
+	}
+}
+
+func TestRangeCounts(t *testing.T) {
+	cleanDb()
+
+	storage, err := NewWatchStorage(testDbName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	storage.CreateSchema()
+
+	err = storage.InsertKeyRows([]KeyRow{
+		{Id: 1, CreatedAt: "2024-03-04 01:30:00", NrKeys: 10},
+		{Id: 2, CreatedAt: "2024-03-04 05:10:00", NrKeys: 20},
+		{Id: 3, CreatedAt: "2024-03-04 05:50:00", NrKeys: 5},
+		{Id: 4, CreatedAt: "2024-03-11 12:00:00", NrKeys: 1},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	loc := time.FixedZone("test", -2*60*60)
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	expect := func(bucket string, newDayHour int, expected []RangeCount) {
+		counts, err := storage.RangeCounts(from, to, bucket, loc, newDayHour)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(counts, expected) {
+			t.Fatalf("%s buckets: expected %v, got %v", bucket, expected, counts)
+		}
+	}
+
+	expect(BucketHour, 0, []RangeCount{
+		{"2024-03-03 23", 10},
+		{"2024-03-04 03", 25},
+		{"2024-03-11 10", 1},
+	})
+
+	expect(BucketDay, 0, []RangeCount{
+		{"2024-03-03", 10},
+		{"2024-03-04", 25},
+		{"2024-03-11", 1},
+	})
+
+	// 03:10 local is still part of the previous day when days start at 4
+	expect(BucketDay, 4, []RangeCount{
+		{"2024-03-03", 35},
+		{"2024-03-11", 1},
+	})
+
+	expect(BucketWeek, 0, []RangeCount{
+		{"2024-02-26", 10},
+		{"2024-03-04", 25},
+		{"2024-03-11", 1},
+	})
+
+	expect(BucketMonth, 0, []RangeCount{{"2024-03", 36}})
+
+	counts, err := storage.RangeCounts(from, time.Date(2024, 3, 4, 5, 0, 0, 0, time.UTC), BucketYear, loc, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(counts, []RangeCount{{"2024", 10}}) {
+		t.Fatalf("Expected range to exclude rows after to, got %v", counts)
+	}
+}
+
+func TestUtcOffsetMigration(t *testing.T) {
+	cleanDb()
+
+	storage, err := NewWatchStorage(testDbName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// keys as created before any columns were added
+	_, err = storage.db.Exec(`
+		CREATE TABLE keys (id INTEGER NOT NULL, created_at DATETIME, nrkeys INTEGER, PRIMARY KEY (id));
+		INSERT INTO keys(created_at, nrkeys) VALUES
+			('2024-03-10 01:30:00.123456789-05:00', 10),
+			('2024-03-10 23:00:00+05:30', 20),
+			('2024-03-10 06:30:00', 30);
+	`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := storage.UpdateSchema(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// running it again leaves the rows alone
+	if err := storage.UpdateSchema(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []struct {
+		createdAt string
+		offset    sql.NullInt64
+	}{
+		{"2024-03-10 06:30:00", sql.NullInt64{Int64: -5 * 60 * 60, Valid: true}},
+		{"2024-03-10 17:30:00", sql.NullInt64{Int64: 5*60*60 + 30*60, Valid: true}},
+		{"2024-03-10 06:30:00", sql.NullInt64{}},
+	}
+
+	rows, err := storage.db.Query(`select cast(created_at as text), utc_offset from keys order by id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		var createdAt string
+		var offset sql.NullInt64
+		if err := rows.Scan(&createdAt, &offset); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if createdAt != expected[i].createdAt || offset != expected[i].offset {
+			t.Fatalf("Row %d: expected %v, got %s %v", i+1, expected[i], createdAt, offset)
+		}
+	}
+
+	if err := storage.WriteKeys(5); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var offset int
+	if err := storage.db.QueryRow(`select utc_offset from keys order by id desc limit 1`).Scan(&offset); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, localOffset := time.Now().Zone(); offset != localOffset {
+		t.Fatalf("Expected the local offset %d, got %d", localOffset, offset)
+	}
+}
+
+func TestDaylightSavingCounts(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// clocks go forward from 2:00 to 3:00 on March 10th 2024, and back from
+	// 2:00 to 1:00 on November 3rd 2024
+	err = storage.InsertKeyRows([]KeyRow{
+		{Id: 1, CreatedAt: "2024-03-09 17:00:00", NrKeys: 5},  // 12:00 EST
+		{Id: 2, CreatedAt: "2024-03-10 06:30:00", NrKeys: 10}, // 01:30 EST
+		{Id: 3, CreatedAt: "2024-03-10 07:30:00", NrKeys: 20}, // 03:30 EDT
+		{Id: 4, CreatedAt: "2024-03-10 08:30:00", NrKeys: 40}, // 04:30 EDT
+		{Id: 5, CreatedAt: "2024-11-03 05:30:00", NrKeys: 7},  // 01:30 EDT
+		{Id: 6, CreatedAt: "2024-11-03 06:30:00", NrKeys: 8},  // 01:30 EST
+		{Id: 7, CreatedAt: "2024-11-03 08:59:00", NrKeys: 1},  // 03:59 EST
+		{Id: 8, CreatedAt: "2024-11-03 09:00:00", NrKeys: 2},  // 04:00 EST
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	daily, err := storage.DailyCounts(7, 4, time.Date(2024, 3, 12, 12, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the day starts at 4:00 on the wall clock, even though only three hours
+	// have passed since midnight
+	if expected := []DailyCount{{"2024-03-09", 35}, {"2024-03-10", 40}}; !reflect.DeepEqual(daily, expected) {
+		t.Fatalf("Expected %v, got %v", expected, daily)
+	}
+
+	daily, err = storage.DailyCounts(3, 4, time.Date(2024, 11, 4, 12, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// and at 4:00 even though five hours have passed since midnight
+	if expected := []DailyCount{{"2024-11-02", 16}, {"2024-11-03", 2}}; !reflect.DeepEqual(daily, expected) {
+		t.Fatalf("Expected %v, got %v", expected, daily)
+	}
+
+	hourly, err := storage.HourlyCounts(24, 0, time.Date(2024, 3, 10, 12, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	springHourly := []HourlyCount{
+		{"2024-03-09 12", 5},
+		{"2024-03-10 01", 10},
+		{"2024-03-10 03", 20},
+		{"2024-03-10 04", 40},
+	}
+	if !reflect.DeepEqual(hourly, springHourly) {
+		t.Fatalf("Expected %v, got %v", springHourly, hourly)
+	}
+
+	// the same 24 hours, a day later
+	hourly, err = storage.HourlyCounts(24, 1, time.Date(2024, 3, 11, 12, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(hourly, springHourly) {
+		t.Fatalf("Expected %v, got %v", springHourly, hourly)
+	}
+
+	// both 1:00 hours are counted together
+	hourly, err = storage.HourlyCountsForDate("2024-11-03", loc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	fallHourly := []HourlyCount{
+		{"2024-11-03 01", 15},
+		{"2024-11-03 03", 1},
+		{"2024-11-03 04", 2},
+	}
+	if !reflect.DeepEqual(hourly, fallHourly) {
+		t.Fatalf("Expected %v, got %v", fallHourly, hourly)
+	}
+}
+
+func TestStats(t *testing.T) {
+	cleanDb()
+
+	storage, err := NewWatchStorage(testDbName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	storage.CreateSchema()
+
+	err = storage.InsertKeyRows([]KeyRow{
+		{Id: 1, CreatedAt: "2024-03-01 12:00:00", NrKeys: 1500},
+		{Id: 2, CreatedAt: "2024-03-02 12:00:00", NrKeys: 1000},
+		{Id: 3, CreatedAt: "2024-03-02 12:30:00", NrKeys: 1000},
+		{Id: 4, CreatedAt: "2024-03-03 12:00:00", NrKeys: 500},
+		{Id: 5, CreatedAt: "2024-03-04 12:00:00", NrKeys: 1200},
+		{Id: 6, CreatedAt: "2024-03-05 12:00:00", NrKeys: 1100},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Date(2024, 3, 6, 10, 0, 0, 0, time.UTC)
+	stats, err := storage.Stats(1000, 0, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// today has no keys yet, so the streak ending yesterday is still current
+	if stats.CurrentStreak != (Streak{Days: 2, Start: "2024-03-04", End: "2024-03-05"}) {
+		t.Fatalf("Unexpected current streak %+v", stats.CurrentStreak)
+	}
+
+	if stats.LongestStreak != (Streak{Days: 2, Start: "2024-03-01", End: "2024-03-02"}) {
+		t.Fatalf("Unexpected longest streak %+v", stats.LongestStreak)
+	}
+
+	if *stats.BestDay != (BestPeriod{"2024-03-02", 2000}) {
+		t.Fatalf("Unexpected best day %+v", stats.BestDay)
+	}
+
+	if *stats.BestHour != (BestPeriod{"2024-03-02 12", 2000}) {
+		t.Fatalf("Unexpected best hour %+v", stats.BestHour)
+	}
+
+	if *stats.BestWeek != (BestPeriod{"2024-02-26", 4000}) {
+		t.Fatalf("Unexpected best week %+v", stats.BestWeek)
+	}
+
+	// 2024-03-01 is a Friday, 2024-03-06 a Wednesday with no keys
+	if stats.WeekdayAverages[4] != (WeekdayAverage{"Fri", 1500}) || stats.WeekdayAverages[2] != (WeekdayAverage{"Wed", 0}) {
+		t.Fatalf("Unexpected weekday averages %+v", stats.WeekdayAverages)
+	}
+
+	if !reflect.DeepEqual(stats.YearTotals, []YearTotal{{"2024", 6300}}) {
+		t.Fatalf("Unexpected year totals %+v", stats.YearTotals)
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	now := time.Date(2024, 3, 13, 12, 0, 0, 0, time.UTC)
+	storage.SetClock(ClockFunc(func() time.Time { return now }))
+
+	writer := storage.NewBatchWriter(3, 0)
+
+	expectTotal := func(expected int64) {
+		t.Helper()
+
+		total, err := storage.TotalKeys()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if total != expected {
+			t.Fatalf("Expected %d keys stored, got %d", expected, total)
+		}
+	}
+
+	for _, keys := range []int{1, 2} {
+		if err := writer.WriteKeys(keys); err != nil {
+			t.Fatal(err.Error())
+		}
+		now = now.Add(time.Minute)
+	}
+	expectTotal(0)
+
+	// the third write fills the batch
+	if err := writer.WriteWindowKeys(4, "kitty", "vim", "selfwatch"); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectTotal(7)
+
+	if err := writer.WriteKeys(8); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectTotal(7)
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectTotal(15)
+
+	// rows keep the time they were written to the batch
+	rows, err := storage.KeyCountsAfterId(0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []KeyRow{
+		{1, "2024-03-13 12:00:00", 1},
+		{2, "2024-03-13 12:01:00", 2},
+		{3, "2024-03-13 12:02:00", 4},
+		{4, "2024-03-13 12:02:00", 8},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Expected %v, got %v", expected, rows)
+	}
+
+	// failed writes stay queued, dropping the oldest past maxPending
+	writer = storage.NewBatchWriter(1, 0)
+	writer.maxPending = 2
+
+	if _, err := storage.db.Exec(`alter table keys rename to keys_moved`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, keys := range []int{16, 32, 64} {
+		if err := writer.WriteKeys(keys); err == nil {
+			t.Fatal("Expected an error writing to a missing table")
+		}
+	}
+
+	if _, err := storage.db.Exec(`alter table keys_moved rename to keys`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectTotal(111)
+}
+
+// TestConcurrentReadWrite reads through a second connection pool, as the web
+// server does from its own process, while keys are written
+func TestConcurrentReadWrite(t *testing.T) {
+	writer := newTestStorage(t, testDbName)
+
+	reader, err := NewWatchStorage(testDbName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer reader.Close()
+
+	const writes = 200
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < writes; i++ {
+			if err := writer.WriteKeys(1); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			total, err := reader.TotalKeys()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if total != writes {
+				t.Fatalf("Expected %d keys, got %d", writes, total)
+			}
+			return
+		default:
+			if _, err := reader.DailyCounts(30, 4, reader.Now()); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+}
+
+func BenchmarkWriteKeys(b *testing.B) {
+	storage := newBenchmarkStorage(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := storage.WriteKeys(1); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkBatchWriter(b *testing.B) {
+	storage := newBenchmarkStorage(b)
+	writer := storage.NewBatchWriter(100, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := writer.WriteKeys(1); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		b.Fatal(err.Error())
+	}
+}
+
+// BenchmarkReadWhileWriting measures reads made through a second connection
+// pool while keys are written continuously. Any "database is locked" error
+// fails the benchmark.
+func BenchmarkReadWhileWriting(b *testing.B) {
+	writer := newBenchmarkStorage(b)
+
+	reader, err := NewWatchStorage(benchmarkDbName)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer reader.Close()
+
+	// written before the counted days so reads don't slow down as rows are
+	// added, they still wait on the same locks
+	written := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	writer.SetClock(ClockFunc(func() time.Time { return written }))
+
+	stop := make(chan struct{})
+	writeErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				writeErr <- nil
+				return
+			default:
+			}
+
+			if err := writer.WriteKeys(1); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := reader.DailyCounts(1, 4, reader.Now()); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	b.StopTimer()
+
+	close(stop)
+	if err := <-writeErr; err != nil {
+		b.Fatal(err.Error())
+	}
+}
+
+const benchmarkDbName = "bench.db"
+
+func newBenchmarkStorage(b *testing.B) *WatchStorage {
+	removeDb(benchmarkDbName)
+	b.Cleanup(func() { removeDb(benchmarkDbName) })
+
+	storage, err := NewWatchStorage(benchmarkDbName)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	b.Cleanup(func() { storage.Close() })
+
+	storage.CreateSchema()
+	if err := storage.UpdateSchema(); err != nil {
+		b.Fatal(err.Error())
+	}
+
+	return storage
 }
@@ -0,0 +1,126 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// how often the stream checks the database for new rows. The recorder runs
+// in another process, so polling is the only way to observe its writes.
+const streamPollInterval = 2 * time.Second
+
+// a comment is sent after this many polls without events to keep proxies
+// from closing the connection
+const streamKeepAlivePolls = 15
+
+type todayEvent struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+func (ws *WebServer) today() (*todayEvent, error) {
+	now := ws.Storage.Now().In(ws.Config.Location())
+	start := LogicalDayStart(now, ws.Config.NewDayHour)
+
+	count, err := ws.Storage.TotalCount(start, now.Add(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+
+	return &todayEvent{
+		Day:   start.Format("2006-01-02"),
+		Count: count,
+	}, nil
+}
+
+// handleStream sends a `flush` event for every row written after the client
+// connects, followed by a `today` event with the running total for the day
+func (ws *WebServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	_, lastId, err := ws.Storage.GetLastKeyPress()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	sendToday := func() error {
+		today, err := ws.today()
+		if err != nil {
+			return err
+		}
+		return writeEvent(w, "today", today)
+	}
+
+	if err := sendToday(); err != nil {
+		log.Printf("Error streaming: %v", err)
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	idlePolls := 0
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		rows, err := ws.Storage.KeyCountsAfterId(lastId)
+		if err != nil {
+			log.Printf("Error streaming: %v", err)
+			return
+		}
+
+		if len(rows) == 0 {
+			idlePolls += 1
+			if idlePolls >= streamKeepAlivePolls {
+				idlePolls = 0
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+			continue
+		}
+
+		idlePolls = 0
+
+		for _, row := range rows {
+			if err := writeEvent(w, "flush", row); err != nil {
+				return
+			}
+			lastId = row.Id
+		}
+
+		if err := sendToday(); err != nil {
+			log.Printf("Error streaming: %v", err)
+			return
+		}
+
+		flusher.Flush()
+	}
+}
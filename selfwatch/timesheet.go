@@ -0,0 +1,304 @@
+package selfwatch
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Formats accepted by Timesheet.Write
+const (
+	TimesheetFormatText = "text"
+	TimesheetFormatCSV  = "csv"
+	TimesheetFormatICal = "ical"
+)
+
+// TimesheetSession is continuous activity in one project
+type TimesheetSession struct {
+	Project string    `json:"project"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Keys    int64     `json:"keys"`
+}
+
+func (s TimesheetSession) Minutes() int64 {
+	return int64(s.End.Sub(s.Start) / time.Minute)
+}
+
+// TimesheetEntry is the time spent on a project in a day
+type TimesheetEntry struct {
+	Day     string `json:"day"`
+	Project string `json:"project"`
+	// Minutes is the time spent rounded up to the timesheet's rounding,
+	// ActualMinutes is before rounding
+	Minutes       int64 `json:"minutes"`
+	ActualMinutes int64 `json:"actualMinutes"`
+	Sessions      int   `json:"sessions"`
+	Keys          int64 `json:"keys"`
+}
+
+type Timesheet struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Round is the number of minutes each entry is rounded up to a multiple of
+	Round    int64              `json:"round"`
+	Entries  []TimesheetEntry   `json:"entries"`
+	Sessions []TimesheetSession `json:"sessions"`
+}
+
+// TotalMinutes sums the rounded minutes of every entry
+func (t *Timesheet) TotalMinutes() int64 {
+	var total int64
+	for _, entry := range t.Entries {
+		total += entry.Minutes
+	}
+	return total
+}
+
+// Timesheet groups the activity in [from, to) into sessions by project, and
+// totals them per day and project. Each active minute belongs to the project
+// with the most keys in it. A session ends after sessionIdle without keys,
+// when a minute belongs to another project or when a new day starts. When
+// project isn't empty only that project is included.
+func (c keyCounts) Timesheet(from, to time.Time, newDayHour int, sessionIdle time.Duration, round int64, project string) (*Timesheet, error) {
+	loc := from.Location()
+	timesheet := &Timesheet{
+		Start:    from,
+		End:      to,
+		Round:    round,
+		Entries:  make([]TimesheetEntry, 0),
+		Sessions: make([]TimesheetSession, 0),
+	}
+
+	minutes, err := c.source.projectMinuteCounts(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	active := make([]activeMinute, 0, len(minutes))
+	for minute, projects := range minutes {
+		active = append(active, activeMinute{time: minute})
+		current := &active[len(active)-1]
+
+		var mostKeys int64 = -1
+		for name, count := range projects {
+			current.keys += count
+			if count > mostKeys || count == mostKeys && name < current.label {
+				current.label, mostKeys = name, count
+			}
+		}
+	}
+
+	for _, session := range groupSessions(active, sessionIdle, newDayHour, loc) {
+		if project == "" || session.label == project {
+			timesheet.Sessions = append(timesheet.Sessions, TimesheetSession{
+				Project: session.label,
+				Start:   session.start,
+				End:     session.end,
+				Keys:    session.keys,
+			})
+		}
+	}
+
+	type entryKey struct{ day, project string }
+	entries := make(map[entryKey]*TimesheetEntry)
+
+	for _, session := range timesheet.Sessions {
+		key := entryKey{bucketKey(session.Start, BucketDay, newDayHour), session.Project}
+		entry := entries[key]
+		if entry == nil {
+			entry = &TimesheetEntry{Day: key.day, Project: key.project}
+			entries[key] = entry
+		}
+
+		entry.ActualMinutes += session.Minutes()
+		entry.Sessions += 1
+		entry.Keys += session.Keys
+	}
+
+	for _, entry := range entries {
+		entry.Minutes = entry.ActualMinutes
+		if round > 1 {
+			entry.Minutes = (entry.ActualMinutes + round - 1) / round * round
+		}
+		timesheet.Entries = append(timesheet.Entries, *entry)
+	}
+
+	sort.Slice(timesheet.Entries, func(i, j int) bool {
+		a, b := timesheet.Entries[i], timesheet.Entries[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return a.Project < b.Project
+	})
+
+	return timesheet, nil
+}
+
+// projectMinuteCounts returns the keys stored per minute and project in
+// [from, to), keyed by the start of the minute in UTC. Keys without a project
+// are counted under an empty one.
+func (s *WatchStorage) projectMinuteCounts(from, to time.Time) (map[time.Time]map[string]int64, error) {
+	rows, err := s.db.Query(`
+		select strftime('%Y-%m-%d %H:%M', created_at), coalesce(project, ''), sum(nrkeys)
+		from keys
+		where `+createdBetween+`
+		group by 1, 2;
+	`, createdBetweenArgs(from, to)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	out := make(map[time.Time]map[string]int64)
+
+	for rows.Next() {
+		var minute, project string
+		var count int64
+
+		if err = rows.Scan(&minute, &project, &count); err != nil {
+			return nil, err
+		}
+
+		t, err := time.Parse("2006-01-02 15:04", minute)
+		if err != nil {
+			return nil, err
+		}
+
+		if out[t] == nil {
+			out[t] = make(map[string]int64)
+		}
+		out[t][project] += count
+	}
+
+	return out, rows.Err()
+}
+
+func projectName(project string) string {
+	if project == "" {
+		return "(unclassified)"
+	}
+	return project
+}
+
+func formatHours(minutes int64) string {
+	return strconv.FormatFloat(float64(minutes)/60, 'f', 2, 64)
+}
+
+func (t *Timesheet) Write(w io.Writer, format string) error {
+	switch format {
+	case "", TimesheetFormatText:
+		return t.writeText(w)
+	case TimesheetFormatCSV:
+		return t.writeCSV(w)
+	case TimesheetFormatICal:
+		return t.writeICal(w, time.Now())
+	}
+	return fmt.Errorf("invalid timesheet format: %s", format)
+}
+
+func (t *Timesheet) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Date\tProject\tHours\tSessions\tKeys")
+	for _, entry := range t.Entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", entry.Day, projectName(entry.Project),
+			formatHours(entry.Minutes), entry.Sessions, entry.Keys)
+	}
+	fmt.Fprintf(tw, "Total\t\t%s\t\t\n", formatHours(t.TotalMinutes()))
+	return tw.Flush()
+}
+
+func (t *Timesheet) writeCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "project", "hours", "minutes", "actual_minutes", "sessions", "keys"})
+	for _, entry := range t.Entries {
+		out.Write([]string{
+			entry.Day,
+			entry.Project,
+			formatHours(entry.Minutes),
+			strconv.FormatInt(entry.Minutes, 10),
+			strconv.FormatInt(entry.ActualMinutes, 10),
+			strconv.Itoa(entry.Sessions),
+			strconv.FormatInt(entry.Keys, 10),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writeICal writes every session as an iCalendar event
+func (t *Timesheet) writeICal(w io.Writer, now time.Time) error {
+	const icalTime = "20060102T150405Z"
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//leafo//selfwatch//EN",
+		"CALSCALE:GREGORIAN",
+	}
+
+	for _, session := range t.Sessions {
+		start := session.Start.UTC()
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%s-%s@selfwatch", start.Format(icalTime), icalUidPart(session.Project)),
+			"DTSTAMP:"+now.UTC().Format(icalTime),
+			"DTSTART:"+start.Format(icalTime),
+			"DTEND:"+session.End.UTC().Format(icalTime),
+			"SUMMARY:"+icalEscape(projectName(session.Project)),
+			"DESCRIPTION:"+icalEscape(fmt.Sprintf("%d keys", session.Keys)),
+			"END:VEVENT",
+		)
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, icalFold(line)+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func icalEscape(text string) string {
+	return icalEscaper.Replace(text)
+}
+
+// icalUidPart keeps the characters of a project name that are safe in a UID
+func icalUidPart(project string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, project)
+}
+
+// icalFold splits lines longer than 75 bytes, continuing them on lines
+// starting with a space, without splitting UTF-8 characters
+func icalFold(line string) string {
+	const limit = 75
+
+	var out strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			out.WriteString("\r\n ")
+			width = 1
+		}
+		out.WriteRune(r)
+		width += size
+	}
+	return out.String()
+}
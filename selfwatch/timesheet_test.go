@@ -0,0 +1,155 @@
+package selfwatch
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimesheet(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	rows := []struct {
+		time    time.Time
+		keys    int
+		project string
+	}{
+		{at(4, 10, 0), 100, "client-a"},
+		{at(4, 10, 2), 50, "client-a"},
+		// the minute belongs to the project with the most keys
+		{at(4, 10, 3), 10, "client-b"},
+		{at(4, 10, 3), 5, "client-a"},
+		{at(4, 10, 4), 20, "client-a"},
+		// after the idle time a new session starts
+		{at(4, 10, 30), 10, "client-a"},
+		{at(4, 11, 0), 5, ""},
+		// still the 4th before the new day hour
+		{at(5, 3, 0), 10, "client-a"},
+		{at(5, 12, 0), 60, "client-a"},
+	}
+
+	for _, row := range rows {
+		_, err := storage.db.Exec(`insert into keys(created_at, nrkeys, project) values(?, ?, nullif(?, ''))`,
+			row.time.Format("2006-01-02 15:04:05"), row.keys, row.project)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	timesheet, err := storage.Timesheet(at(4, 4, 0), at(6, 4, 0), 4, 5*time.Minute, 15, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(timesheet.Sessions) != 7 {
+		t.Fatalf("Expected 7 sessions, got %+v", timesheet.Sessions)
+	}
+
+	if first := timesheet.Sessions[0]; first.Project != "client-a" || first.Minutes() != 3 || first.Keys != 150 {
+		t.Fatalf("Unexpected first session %+v", first)
+	}
+
+	if second := timesheet.Sessions[1]; second.Project != "client-b" || second.Minutes() != 1 || second.Keys != 15 {
+		t.Fatalf("Unexpected second session %+v", second)
+	}
+
+	expected := []TimesheetEntry{
+		{Day: "2024-03-04", Project: "", Minutes: 15, ActualMinutes: 1, Sessions: 1, Keys: 5},
+		{Day: "2024-03-04", Project: "client-a", Minutes: 15, ActualMinutes: 6, Sessions: 4, Keys: 190},
+		{Day: "2024-03-04", Project: "client-b", Minutes: 15, ActualMinutes: 1, Sessions: 1, Keys: 15},
+		{Day: "2024-03-05", Project: "client-a", Minutes: 15, ActualMinutes: 1, Sessions: 1, Keys: 60},
+	}
+
+	if len(timesheet.Entries) != len(expected) {
+		t.Fatalf("Unexpected entries %+v", timesheet.Entries)
+	}
+	for i := range expected {
+		if timesheet.Entries[i] != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected[i], timesheet.Entries[i])
+		}
+	}
+
+	if total := timesheet.TotalMinutes(); total != 60 {
+		t.Fatalf("Expected 60 total minutes, got %d", total)
+	}
+
+	var csv strings.Builder
+	if err := timesheet.Write(&csv, TimesheetFormatCSV); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !strings.HasPrefix(csv.String(), "date,project,hours,minutes,actual_minutes,sessions,keys\n2024-03-04,,0.25,15,1,1,5\n") {
+		t.Fatalf("Unexpected CSV:\n%s", csv.String())
+	}
+
+	// only one project
+	timesheet, err = storage.Timesheet(at(4, 4, 0), at(6, 4, 0), 4, 5*time.Minute, 0, "client-b")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(timesheet.Entries) != 1 || timesheet.Entries[0].Minutes != 1 {
+		t.Fatalf("Unexpected entries %+v", timesheet.Entries)
+	}
+
+	var ical strings.Builder
+	if err := timesheet.writeICal(&ical, at(6, 0, 0)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	event := "BEGIN:VEVENT\r\nUID:20240304T100300Z-client-b@selfwatch\r\nDTSTAMP:20240306T000000Z\r\n" +
+		"DTSTART:20240304T100300Z\r\nDTEND:20240304T100400Z\r\nSUMMARY:client-b\r\nDESCRIPTION:15 keys\r\nEND:VEVENT\r\n"
+	if !strings.Contains(ical.String(), event) || !strings.HasSuffix(ical.String(), "END:VCALENDAR\r\n") {
+		t.Fatalf("Unexpected iCalendar:\n%s", ical.String())
+	}
+}
+
+func TestTimesheetDayBoundary(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	// a session from 3:58 to 4:02 is split when the new day starts at 4:00
+	for _, createdAt := range []string{"2024-03-05 03:58:00", "2024-03-05 04:01:00"} {
+		_, err := storage.db.Exec(`insert into keys(created_at, nrkeys, project) values(?, 10, 'client-a')`, createdAt)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	from := time.Date(2024, 3, 4, 4, 0, 0, 0, time.UTC)
+	timesheet, err := storage.Timesheet(from, from.AddDate(0, 0, 2), 4, 5*time.Minute, 0, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []TimesheetEntry{
+		{Day: "2024-03-04", Project: "client-a", Minutes: 1, ActualMinutes: 1, Sessions: 1, Keys: 10},
+		{Day: "2024-03-05", Project: "client-a", Minutes: 1, ActualMinutes: 1, Sessions: 1, Keys: 10},
+	}
+
+	if len(timesheet.Entries) != len(expected) || timesheet.Entries[0] != expected[0] || timesheet.Entries[1] != expected[1] {
+		t.Fatalf("Expected %+v, got %+v", expected, timesheet.Entries)
+	}
+}
+
+func TestICalFold(t *testing.T) {
+	line := "SUMMARY:" + strings.Repeat("é", 40)
+	folded := icalFold(line)
+
+	for _, part := range strings.Split(folded, "\r\n") {
+		if len(part) > 75 {
+			t.Fatalf("Expected lines of at most 75 bytes, got %d", len(part))
+		}
+	}
+
+	if strings.ReplaceAll(folded, "\r\n ", "") != line {
+		t.Fatalf("Expected unfolding to restore the line, got %q", folded)
+	}
+
+	if icalEscape("a, b; c\\d") != `a\, b\; c\\d` {
+		t.Fatalf("Unexpected escape %q", icalEscape("a, b; c\\d"))
+	}
+}
@@ -1,13 +1,17 @@
 package selfwatch
 
 import (
+	"crypto/tls"
 	"embed"
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,24 +19,74 @@ import (
 var webAssets embed.FS
 
 type WebServer struct {
-	Storage    *WatchStorage
+	Storage    Storage
 	Config     *config
 	ListenAddr string
 	CommitHash string
 	BuildDate  string
+
+	// Static is set while exporting a snapshot of the dashboard with Publish
+	Static *PublishOptions
+
+	sessions *webSessions
+	server   *http.Server
 }
 
-func NewWebServer(storage *WatchStorage, cfg *config, addr, commitHash, buildDate string) *WebServer {
+func NewWebServer(storage Storage, cfg *config, addr, commitHash, buildDate string) *WebServer {
 	return &WebServer{
 		Storage:    storage,
 		Config:     cfg,
 		ListenAddr: addr,
 		CommitHash: commitHash,
 		BuildDate:  buildDate,
+		sessions:   newWebSessions(),
+		server:     &http.Server{},
 	}
 }
 
 func (ws *WebServer) Start() error {
+	handler, err := ws.Handler()
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := webTLSConfig(ws.Config, ws.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	listener, err := listen(ws.ListenAddr, ws.Config.WebSocketMode)
+	if err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "https"
+	}
+
+	if strings.HasPrefix(ws.ListenAddr, unixAddrPrefix) {
+		log.Printf("Starting web dashboard (%s) on %s", scheme, ws.ListenAddr)
+	} else {
+		log.Printf("Starting web dashboard at %s://%s", scheme, ws.ListenAddr)
+	}
+
+	ws.server.Handler = handler
+	if err := ws.server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stops the server started by Start, removing its unix socket
+func (ws *WebServer) Close() error {
+	return ws.server.Close()
+}
+
+// Handler creates the handler serving the dashboard and API, requiring
+// authentication if it is configured
+func (ws *WebServer) Handler() (http.Handler, error) {
 	mux := http.NewServeMux()
 
 	// API routes
@@ -40,21 +94,33 @@ func (ws *WebServer) Start() error {
 	mux.HandleFunc("/api/daily", ws.handleDaily)
 	mux.HandleFunc("/api/yearly", ws.handleYearly)
 	mux.HandleFunc("/api/weekly-heatmap", ws.handleWeeklyHeatmap)
+	mux.HandleFunc("/api/counts", ws.handleCounts)
+	mux.HandleFunc("/api/stats", ws.handleStats)
+	mux.HandleFunc("/api/goals", ws.handleGoals)
+	mux.HandleFunc("/api/projects", ws.handleProjects)
+	mux.HandleFunc("/api/sync-status", ws.handleSyncStatus)
+	mux.HandleFunc("/api/annotations", ws.handleAnnotations)
+	mux.HandleFunc("/api/annotations/", ws.handleAnnotation)
+	mux.HandleFunc("/api/stream", ws.handleStream)
+	mux.HandleFunc("/api/render/contributions.svg", ws.handleRenderContributions)
+	mux.HandleFunc("/api/render/daily.svg", ws.handleRenderDaily)
+	mux.HandleFunc("/metrics", ws.handleMetrics)
 
-	// Parse index.html as template
-	indexContent, err := webAssets.ReadFile("web/index.html")
-	if err != nil {
-		return err
+	if ws.Config.WebToken != "" {
+		if err := ws.handleLogin(mux); err != nil {
+			return nil, err
+		}
 	}
-	indexTmpl, err := template.New("index").Parse(string(indexContent))
+
+	indexTmpl, err := indexTemplate()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Static files (for CSS, JS, etc.)
 	webFS, err := fs.Sub(webAssets, "web")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	fileServer := http.FileServer(http.FS(webFS))
 
@@ -68,8 +134,16 @@ func (ws *WebServer) Start() error {
 		}
 	})
 
-	log.Printf("Starting web dashboard at http://%s", ws.ListenAddr)
-	return http.ListenAndServe(ws.ListenAddr, mux)
+	return ws.requireAuth(mux), nil
+}
+
+// indexTemplate parses index.html, which is rendered with the WebServer
+func indexTemplate() (*template.Template, error) {
+	indexContent, err := webAssets.ReadFile("web/index.html")
+	if err != nil {
+		return nil, err
+	}
+	return template.New("index").Parse(string(indexContent))
 }
 
 func isValidDateFormat(date string) bool {
@@ -80,9 +154,105 @@ func isValidDateFormat(date string) bool {
 	return err == nil
 }
 
+// parseRangeTime parses an RFC 3339 time or a YYYY-MM-DD date. Dates refer
+// to the start of that day in loc, which begins at newDayHour.
+func parseRangeTime(value string, loc *time.Location, newDayHour int) (time.Time, bool, error) {
+	if isValidDateFormat(value) {
+		day, err := time.ParseInLocation("2006-01-02", value, loc)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return DayStart(day, newDayHour), true, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// location returns the time zone named by the tz parameter, or the
+// configured one if it isn't set
+func (ws *WebServer) location(query url.Values) (*time.Location, error) {
+	tz := query.Get("tz")
+	if tz == "" {
+		return ws.Config.Location(), nil
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tz, expected an IANA time zone name")
+	}
+	return loc, nil
+}
+
+func (ws *WebServer) handleCounts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	loc, err := ws.location(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bucket := query.Get("bucket")
+	if bucket == "" {
+		bucket = BucketDay
+	}
+	if !IsValidBucket(bucket) {
+		http.Error(w, "Invalid bucket, expected minute, hour, day, week, month or year", http.StatusBadRequest)
+		return
+	}
+
+	to := ws.Storage.Now().In(loc)
+	if toParam := query.Get("to"); toParam != "" {
+		parsed, isDate, err := parseRangeTime(toParam, loc, ws.Config.NewDayHour)
+		if err != nil {
+			http.Error(w, "Invalid to, expected YYYY-MM-DD or RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		// a date includes the whole day
+		if isDate {
+			parsed = parsed.AddDate(0, 0, 1)
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -30)
+	if fromParam := query.Get("from"); fromParam != "" {
+		parsed, _, err := parseRangeTime(fromParam, loc, ws.Config.NewDayHour)
+		if err != nil {
+			http.Error(w, "Invalid from, expected YYYY-MM-DD or RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	if days := maxBucketDays[bucket]; to.Sub(from) > time.Duration(days)*24*time.Hour {
+		http.Error(w, fmt.Sprintf("Range too long, %s buckets cover at most %d days", bucket, days), http.StatusBadRequest)
+		return
+	}
+
+	counts, err := ws.Storage.RangeCounts(from, to, bucket, loc, ws.Config.NewDayHour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
+
 func (ws *WebServer) handleHourly(w http.ResponseWriter, r *http.Request) {
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var counts []HourlyCount
-	var err error
 
 	// Check for specific date first (e.g., ?date=2024-12-10)
 	if dateParam := r.URL.Query().Get("date"); dateParam != "" {
@@ -90,7 +260,7 @@ func (ws *WebServer) handleHourly(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid date format, expected YYYY-MM-DD", http.StatusBadRequest)
 			return
 		}
-		counts, err = ws.Storage.HourlyCountsForDate(dateParam)
+		counts, err = ws.Storage.HourlyCountsForDate(dateParam, loc)
 	} else {
 		// Fall back to offset-based query
 		offset := 0
@@ -99,7 +269,7 @@ func (ws *WebServer) handleHourly(w http.ResponseWriter, r *http.Request) {
 				offset = parsed
 			}
 		}
-		counts, err = ws.Storage.HourlyCounts(24, offset)
+		counts, err = ws.Storage.HourlyCounts(24, offset, ws.Storage.Now().In(loc))
 	}
 
 	if err != nil {
@@ -111,7 +281,13 @@ func (ws *WebServer) handleHourly(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ws *WebServer) handleDaily(w http.ResponseWriter, r *http.Request) {
-	counts, err := ws.Storage.DailyCounts(30, ws.Config.NewDayHour)
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	counts, err := ws.Storage.DailyCounts(30, ws.Config.NewDayHour, ws.Storage.Now().In(loc))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -121,13 +297,19 @@ func (ws *WebServer) handleDaily(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ws *WebServer) handleYearly(w http.ResponseWriter, r *http.Request) {
-	year := time.Now().Year()
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	year := ws.Storage.Now().In(loc).Year()
 	if yearParam := r.URL.Query().Get("year"); yearParam != "" {
 		if parsed, err := strconv.Atoi(yearParam); err == nil && parsed >= 1970 && parsed <= year {
 			year = parsed
 		}
 	}
-	counts, err := ws.Storage.YearlyCounts(year, ws.Config.NewDayHour)
+	counts, err := ws.Storage.YearlyCounts(year, ws.Config.NewDayHour, loc)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -137,7 +319,13 @@ func (ws *WebServer) handleYearly(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ws *WebServer) handleWeeklyHeatmap(w http.ResponseWriter, r *http.Request) {
-	response, err := ws.Storage.WeeklyHourlyGrid()
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := ws.Storage.WeeklyHourlyGrid(ws.Storage.Now().In(loc))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -145,3 +333,154 @@ func (ws *WebServer) handleWeeklyHeatmap(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+func (ws *WebServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	threshold := ws.Config.StreakThreshold
+	if thresholdParam := r.URL.Query().Get("threshold"); thresholdParam != "" {
+		if parsed, err := strconv.ParseInt(thresholdParam, 10, 64); err == nil && parsed > 0 {
+			threshold = parsed
+		}
+	}
+
+	stats, err := ws.Storage.Stats(threshold, ws.Config.NewDayHour, ws.Storage.Now().In(loc))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (ws *WebServer) handleGoals(w http.ResponseWriter, r *http.Request) {
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	goals, err := ws.Storage.EvaluateGoals(ws.Config.Goals, ws.Config.NewDayHour, ws.Storage.Now().In(loc))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(goals)
+}
+
+func (ws *WebServer) handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := ws.Storage.SyncStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (ws *WebServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	writeStorageMetrics(w, ws.Storage)
+}
+
+// renderTheme reads the theme for a rendered chart from the query, with the
+// bg and color parameters overriding its background and activity color
+func renderTheme(query url.Values) (SVGTheme, error) {
+	theme, err := ParseSVGTheme(query.Get("theme"))
+	if err != nil {
+		return theme, err
+	}
+
+	if bg := query.Get("bg"); bg != "" {
+		if bg != "transparent" && !isHexColor("#"+bg) {
+			return theme, fmt.Errorf("invalid bg, expected a hex color or transparent")
+		}
+		theme.Background = bg
+		if bg != "transparent" {
+			theme.Background = "#" + bg
+		}
+	}
+
+	if color := query.Get("color"); color != "" {
+		if !isHexColor("#" + color) {
+			return theme, fmt.Errorf("invalid color, expected a hex color")
+		}
+		theme.High = "#" + color
+		theme.Bar = "#" + color
+	}
+
+	return theme, nil
+}
+
+func (ws *WebServer) handleRenderContributions(w http.ResponseWriter, r *http.Request) {
+	theme, err := renderTheme(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	year := ws.Storage.Now().In(loc).Year()
+	if yearParam := r.URL.Query().Get("year"); yearParam != "" {
+		if parsed, err := strconv.Atoi(yearParam); err == nil && parsed >= 1970 && parsed <= year {
+			year = parsed
+		}
+	}
+
+	counts, err := ws.Storage.YearlyCounts(year, ws.Config.NewDayHour, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	RenderContributions(w, counts, year, theme)
+}
+
+func (ws *WebServer) handleRenderDaily(w http.ResponseWriter, r *http.Request) {
+	theme, err := renderTheme(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc, err := ws.location(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	days := 30
+	if daysParam := r.URL.Query().Get("days"); daysParam != "" {
+		if parsed, err := strconv.Atoi(daysParam); err == nil && parsed > 0 && parsed <= 366 {
+			days = parsed
+		}
+	}
+
+	width := 720
+	if widthParam := r.URL.Query().Get("width"); widthParam != "" {
+		if parsed, err := strconv.Atoi(widthParam); err == nil && parsed >= 100 && parsed <= 4000 {
+			width = parsed
+		}
+	}
+
+	now := ws.Storage.Now().In(loc)
+	counts, err := ws.Storage.DailyCounts(days, ws.Config.NewDayHour, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	RenderBarChart(w, DailyBars(counts, days, ws.Config.NewDayHour, now), width, theme)
+}
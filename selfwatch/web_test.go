@@ -0,0 +1,268 @@
+package selfwatch
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestWebServer(t *testing.T, cfg config) *httptest.Server {
+	storage := newTestStorage(t, testDbName)
+
+	ws := NewWebServer(storage, &cfg, "", "test", "today")
+	handler, err := ws.Handler()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return httptest.NewServer(handler)
+}
+
+func expectStatus(t *testing.T, res *http.Response, err error, status int) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d, got %d", res.Request.Method, res.Request.URL.Path, status, res.StatusCode)
+	}
+}
+
+func TestWebNoAuth(t *testing.T) {
+	server := newTestWebServer(t, defaultConfig)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/daily")
+	expectStatus(t, res, err, http.StatusOK)
+}
+
+func TestWebBasicAuth(t *testing.T) {
+	cfg := defaultConfig
+	cfg.WebUsername = "leafo"
+	cfg.WebPassword = "hunter2"
+
+	server := newTestWebServer(t, cfg)
+	defer server.Close()
+
+	for _, path := range []string{"/", "/api/daily", "/style.css"} {
+		res, err := http.Get(server.URL + path)
+		expectStatus(t, res, err, http.StatusUnauthorized)
+
+		if res.Header.Get("WWW-Authenticate") == "" {
+			t.Fatal("Expected basic auth challenge")
+		}
+
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.SetBasicAuth("leafo", "wrong")
+		res, err = http.DefaultClient.Do(req)
+		expectStatus(t, res, err, http.StatusUnauthorized)
+
+		req.SetBasicAuth("leafo", "hunter2")
+		res, err = http.DefaultClient.Do(req)
+		expectStatus(t, res, err, http.StatusOK)
+	}
+}
+
+func TestWebTokenLogin(t *testing.T) {
+	cfg := defaultConfig
+	cfg.WebToken = "letmein"
+
+	server := newTestWebServer(t, cfg)
+	defer server.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	res, err := client.Get(server.URL + "/api/daily")
+	expectStatus(t, res, err, http.StatusUnauthorized)
+
+	// the dashboard redirects to the login form
+	res, err = client.Get(server.URL + "/")
+	expectStatus(t, res, err, http.StatusOK)
+	if res.Request.URL.Path != "/login" {
+		t.Fatalf("Expected redirect to /login, got %s", res.Request.URL.Path)
+	}
+
+	res, err = client.PostForm(server.URL+"/login", url.Values{"token": {"wrong"}})
+	expectStatus(t, res, err, http.StatusUnauthorized)
+
+	res, err = client.PostForm(server.URL+"/login", url.Values{"token": {"letmein"}})
+	expectStatus(t, res, err, http.StatusOK)
+
+	res, err = client.Get(server.URL + "/api/daily")
+	expectStatus(t, res, err, http.StatusOK)
+
+	res, err = client.Get(server.URL + "/style.css")
+	expectStatus(t, res, err, http.StatusOK)
+
+	// bearer tokens work without logging in
+	req, _ := http.NewRequest("GET", server.URL+"/api/daily", nil)
+	req.Header.Set("Authorization", "Bearer letmein")
+	res, err = http.DefaultClient.Do(req)
+	expectStatus(t, res, err, http.StatusOK)
+
+	res, err = client.Get(server.URL + "/logout")
+	expectStatus(t, res, err, http.StatusOK)
+
+	res, err = client.Get(server.URL + "/api/daily")
+	expectStatus(t, res, err, http.StatusUnauthorized)
+}
+
+func TestWebUnixSocketTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := defaultConfig
+	cfg.DbName = filepath.Join(dir, "selfwatch.db")
+	cfg.WebTLS = true
+	cfg.WebSocketMode = "0600"
+
+	socket := filepath.Join(dir, "web.sock")
+
+	tlsConfig, err := webTLSConfig(&cfg, unixAddrPrefix+socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	listener, err := listen(unixAddrPrefix+socket, cfg.WebSocketMode)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected socket mode 0600, got %v", info.Mode().Perm())
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go server.Serve(tls.NewListener(listener, tlsConfig))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	res, err := client.Get("https://localhost/")
+	expectStatus(t, res, err, http.StatusOK)
+
+	if res.TLS == nil {
+		t.Fatal("Expected a TLS connection")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, selfSignedCertName)); err != nil {
+		t.Fatal("Expected self signed certificate to be saved next to the database")
+	}
+}
+
+func TestWebTimezone(t *testing.T) {
+	cfg := defaultConfig
+	cfg.Timezone = "Asia/Tokyo"
+
+	server := newTestWebServer(t, cfg)
+	defer server.Close()
+
+	storage, err := NewWatchStorage(testDbName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := storage.InsertKeyRows([]KeyRow{{Id: 1, CreatedAt: "2024-03-10 20:00:00", NrKeys: 10}}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hourly := func(query string) []HourlyCount {
+		t.Helper()
+
+		res, err := http.Get(server.URL + "/api/hourly?" + query)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+
+		var counts []HourlyCount
+		if err := json.NewDecoder(res.Body).Decode(&counts); err != nil {
+			t.Fatal(err.Error())
+		}
+		return counts
+	}
+
+	if counts := hourly("date=2024-03-11"); len(counts) != 1 || counts[0] != (HourlyCount{"2024-03-11 05", 10}) {
+		t.Fatalf("Expected hours in the configured time zone, got %v", counts)
+	}
+
+	if counts := hourly("date=2024-03-10&tz=UTC"); len(counts) != 1 || counts[0] != (HourlyCount{"2024-03-10 20", 10}) {
+		t.Fatalf("Expected hours in the tz parameter's time zone, got %v", counts)
+	}
+
+	res, err := http.Get(server.URL + "/api/daily?tz=Mars/Olympus_Mons")
+	expectStatus(t, res, err, http.StatusBadRequest)
+}
+
+func TestWebUnixSocketClose(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestStorage(t, testDbName)
+
+	cfg := defaultConfig
+	cfg.WebSocketMode = "0600"
+
+	socket := filepath.Join(dir, "web.sock")
+	ws := NewWebServer(storage, &cfg, unixAddrPrefix+socket, "test", "today")
+
+	oldMask := syscall.Umask(0022)
+	defer syscall.Umask(oldMask)
+
+	started := make(chan error)
+	go func() {
+		started <- ws.Start()
+	}()
+
+	var info os.FileInfo
+	for i := 0; i < 100; i++ {
+		if info, _ = os.Stat(socket); info != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if info == nil {
+		t.Fatal("Expected the socket to be created")
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected socket mode 0600, got %v", info.Mode().Perm())
+	}
+
+	if err := ws.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := <-started; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if mask := syscall.Umask(0022); mask != 0022 {
+		t.Fatalf("Expected the umask to be restored, got %o", mask)
+	}
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed, got %v", err)
+	}
+}
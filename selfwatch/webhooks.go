@@ -0,0 +1,354 @@
+package selfwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events sent to webhooks
+const (
+	WebhookEventDaySummary    = "day_summary"
+	WebhookEventGoalReached   = "goal_reached"
+	WebhookEventSessionStart  = "session_start"
+	WebhookEventSessionEnd    = "session_end"
+	WebhookEventRecorderError = "recorder_error"
+)
+
+const webhookEventHeader = "X-Selfwatch-Event"
+
+type WebhookConfig struct {
+	Url string
+	// Events limits the webhook to some events, all are sent if empty
+	Events []string
+	// Secret is used to HMAC sign every request when set, the same way as
+	// remote sync requests
+	Secret string
+}
+
+func (h *WebhookConfig) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body posted for every event
+type WebhookPayload struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Host  string      `json:"host,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+type DaySummary struct {
+	Day           string         `json:"day"`
+	Keys          int64          `json:"keys"`
+	ActiveMinutes int64          `json:"active_minutes"`
+	Goals         []GoalProgress `json:"goals,omitempty"`
+}
+
+type SessionSummary struct {
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+	Minutes float64    `json:"minutes"`
+	Keys    int64      `json:"keys"`
+}
+
+type RecorderError struct {
+	Error string `json:"error"`
+	Keys  int    `json:"keys"`
+}
+
+// Webhooks posts activity events from the recorder daemon to every
+// configured webhook
+type Webhooks struct {
+	Hooks      []WebhookConfig
+	Host       string
+	Storage    *WatchStorage
+	Goals      []GoalConfig
+	NewDayHour int
+	// Location is the time zone days are counted in
+	Location *time.Location
+
+	// Retries is how many times a failed delivery is retried, waiting
+	// RetryDelay before the first retry and twice as long for each one after
+	Retries    int
+	RetryDelay time.Duration
+	Client     *http.Client
+
+	mu          sync.Mutex
+	session     *sessionTracker
+	sessionKeys int64
+	dayStart    time.Time
+	reached     map[string]bool
+
+	// deliver is called for every event, it must not block
+	deliver func(WebhookPayload)
+}
+
+// NewWebhooks creates the webhooks from the config, nil if none are
+// configured
+func NewWebhooks(c *config, storage *WatchStorage) *Webhooks {
+	if len(c.Webhooks) == 0 {
+		return nil
+	}
+
+	w := &Webhooks{
+		Hooks:      c.Webhooks,
+		Host:       c.HostId(),
+		Storage:    storage,
+		Goals:      c.Goals,
+		NewDayHour: c.NewDayHour,
+		Location:   c.Location(),
+		Retries:    c.WebhookRetries,
+		RetryDelay: 5 * time.Second,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		session:    newSessionTracker(c.SessionIdle()),
+	}
+
+	w.deliver = w.post
+
+	return w
+}
+
+// Bind sends session and error events from recorder and storage, and checks
+// for day rollovers and reached goals every minute. It wraps the recorder's
+// existing callbacks, so it must be called after WatchStorage.BindRecorder.
+func (w *Webhooks) Bind(recorder *Recorder) {
+	if err := w.start(time.Now().In(w.Location)); err != nil {
+		log.Printf("Error checking goals for webhooks: %v", err)
+	}
+
+	keyRelease := recorder.KeyRelease
+	recorder.KeyRelease = func(event Event) {
+		w.activity(time.Now(), true)
+		if keyRelease != nil {
+			keyRelease(event)
+		}
+	}
+
+	buttonRelease := recorder.ButtonRelease
+	recorder.ButtonRelease = func(event Event) {
+		w.activity(time.Now(), false)
+		if buttonRelease != nil {
+			buttonRelease(event)
+		}
+	}
+
+	w.Storage.OnFlush(w.flushed)
+
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			if err := w.check(now.In(w.Location)); err != nil {
+				log.Printf("Error checking webhook events: %v", err)
+			}
+		}
+	}()
+}
+
+// start remembers the current day and the goals already reached, so
+// restarting doesn't send them again
+func (w *Webhooks) start(now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dayStart = LogicalDayStart(now, w.NewDayHour)
+	w.reached = make(map[string]bool)
+
+	goals, err := w.Storage.EvaluateGoals(w.Goals, w.NewDayHour, now)
+	if err != nil {
+		return err
+	}
+
+	for _, goal := range goals {
+		if goal.Met {
+			w.reached[goal.Name+" "+goal.PeriodStart] = true
+		}
+	}
+
+	return nil
+}
+
+// flushed sends a recorder error for keys that failed to be stored
+func (w *Webhooks) flushed(flush FlushEvent) {
+	if flush.Err != nil {
+		w.send(WebhookEventRecorderError, flush.Time, RecorderError{
+			Error: flush.Err.Error(),
+			Keys:  flush.Keys,
+		})
+	}
+}
+
+func (w *Webhooks) activity(now time.Time, key bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.endSession(now)
+
+	if w.session.activity(now) {
+		w.sessionKeys = 0
+		w.send(WebhookEventSessionStart, now, SessionSummary{Start: now})
+	}
+
+	if key {
+		w.sessionKeys += 1
+	}
+}
+
+// endSession sends the end of the current session if it has gone idle
+func (w *Webhooks) endSession(now time.Time) {
+	if w.session.last.IsZero() || w.session.active(now) {
+		return
+	}
+
+	end := w.session.last
+	w.send(WebhookEventSessionEnd, now, SessionSummary{
+		Start:   w.session.start,
+		End:     &end,
+		Minutes: w.session.last.Sub(w.session.start).Minutes(),
+		Keys:    w.sessionKeys,
+	})
+
+	w.session.last = time.Time{}
+}
+
+// check sends events that are found by polling: idle sessions, a new day
+// starting and goals being reached
+func (w *Webhooks) check(now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.endSession(now)
+
+	if dayStart := LogicalDayStart(now, w.NewDayHour); !dayStart.Equal(w.dayStart) {
+		previous := dayStart.AddDate(0, 0, -1)
+		w.dayStart = dayStart
+
+		summary, err := w.daySummary(previous)
+		if err != nil {
+			return err
+		}
+		w.send(WebhookEventDaySummary, now, summary)
+	}
+
+	goals, err := w.Storage.EvaluateGoals(w.Goals, w.NewDayHour, now)
+	if err != nil {
+		return err
+	}
+
+	for _, goal := range goals {
+		key := goal.Name + " " + goal.PeriodStart
+		if goal.Kind != GoalKindMin || !goal.Met || w.reached[key] {
+			continue
+		}
+
+		w.reached[key] = true
+		w.send(WebhookEventGoalReached, now, goal)
+	}
+
+	return nil
+}
+
+func (w *Webhooks) daySummary(dayStart time.Time) (*DaySummary, error) {
+	minutes, err := w.Storage.minuteCounts(dayStart, dayStart.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &DaySummary{
+		Day:           dayStart.Format("2006-01-02"),
+		ActiveMinutes: int64(len(minutes)),
+	}
+
+	for _, count := range minutes {
+		summary.Keys += count
+	}
+
+	// the final progress of the goals for the day that ended
+	summary.Goals, err = w.Storage.EvaluateGoals(w.Goals, w.NewDayHour, dayStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+func (w *Webhooks) send(event string, now time.Time, data interface{}) {
+	if w.deliver != nil {
+		w.deliver(WebhookPayload{Event: event, Time: now, Host: w.Host, Data: data})
+	}
+}
+
+// post sends payload to every hook that wants it in the background
+func (w *Webhooks) post(payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding webhook: %v", err)
+		return
+	}
+
+	for _, hook := range w.Hooks {
+		if hook.wants(payload.Event) {
+			go w.postRetrying(hook, payload.Event, body)
+		}
+	}
+}
+
+func (w *Webhooks) postRetrying(hook WebhookConfig, event string, body []byte) error {
+	delay := w.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := w.postHook(hook, event, body)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= w.Retries {
+			log.Printf("Error sending %s webhook to %s: %v", event, hook.Url, err)
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *Webhooks) postHook(hook WebhookConfig, event string, body []byte) error {
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+
+	if hook.Secret != "" {
+		signRequest(req, hook.Secret, body)
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+
+	return nil
+}
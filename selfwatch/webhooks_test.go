@@ -0,0 +1,215 @@
+package selfwatch
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookEvents(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	_, err := storage.db.Exec(`insert into keys(created_at, nrkeys) values(?, ?)`, "2024-03-02 10:00:00", 800)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var events []WebhookPayload
+	webhooks := &Webhooks{
+		Storage:    storage,
+		Goals:      []GoalConfig{{Name: "type", Min: goalTarget(1000)}},
+		NewDayHour: 4,
+		session:    newSessionTracker(5 * time.Minute),
+		deliver: func(payload WebhookPayload) {
+			events = append(events, payload)
+		},
+	}
+
+	start := time.Date(2024, 3, 2, 11, 0, 0, 0, time.UTC)
+	if err := webhooks.start(start); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	webhooks.activity(start, true)
+	webhooks.activity(start.Add(time.Minute), true)
+	webhooks.activity(start.Add(2*time.Minute), false)
+
+	// idle long enough to end the session
+	if err := webhooks.check(start.Add(10 * time.Minute)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(events) != 2 || events[0].Event != WebhookEventSessionStart || events[1].Event != WebhookEventSessionEnd {
+		t.Fatalf("Expected a session start and end, got %+v", events)
+	}
+
+	session := events[1].Data.(SessionSummary)
+	if session.Keys != 2 || session.Minutes != 2 || !session.End.Equal(start.Add(2*time.Minute)) {
+		t.Fatalf("Unexpected session %+v", session)
+	}
+
+	// reaching the goal is only sent once
+	_, err = storage.db.Exec(`insert into keys(created_at, nrkeys) values(?, ?)`, "2024-03-02 11:30:00", 300)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	events = nil
+	webhooks.check(start.Add(time.Hour))
+	webhooks.check(start.Add(2 * time.Hour))
+
+	if len(events) != 1 || events[0].Event != WebhookEventGoalReached {
+		t.Fatalf("Expected goal reached, got %+v", events)
+	}
+
+	if goal := events[0].Data.(GoalProgress); goal.Name != "type" || goal.Value != 1100 {
+		t.Fatalf("Unexpected goal %+v", goal)
+	}
+
+	// the next day starts at 4am
+	events = nil
+	webhooks.check(time.Date(2024, 3, 3, 3, 59, 0, 0, time.UTC))
+	if len(events) != 0 {
+		t.Fatalf("Expected no events before the new day hour, got %+v", events)
+	}
+
+	webhooks.check(time.Date(2024, 3, 3, 4, 0, 0, 0, time.UTC))
+	if len(events) != 1 || events[0].Event != WebhookEventDaySummary {
+		t.Fatalf("Expected a day summary, got %+v", events)
+	}
+
+	summary := events[0].Data.(*DaySummary)
+	if summary.Day != "2024-03-02" || summary.Keys != 1100 || summary.ActiveMinutes != 2 || len(summary.Goals) != 1 || !summary.Goals[0].Met {
+		t.Fatalf("Unexpected day summary %+v", summary)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	attempts := 0
+	var received WebhookPayload
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts += 1
+		if attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifySignature(r, body, "secret"); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if r.Header.Get(webhookEventHeader) != WebhookEventRecorderError {
+			http.Error(w, "wrong event", http.StatusBadRequest)
+			return
+		}
+
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	webhooks := &Webhooks{
+		Host:       "laptop",
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	}
+
+	hook := WebhookConfig{Url: server.URL, Secret: "secret"}
+	if !hook.wants(WebhookEventDaySummary) {
+		t.Fatal("Expected a webhook without events to want every event")
+	}
+
+	body, _ := json.Marshal(WebhookPayload{Event: WebhookEventRecorderError, Host: "laptop"})
+	if err := webhooks.postRetrying(hook, WebhookEventRecorderError, body); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if attempts != 2 || received.Event != WebhookEventRecorderError || received.Host != "laptop" {
+		t.Fatalf("Unexpected delivery after %d attempts: %+v", attempts, received)
+	}
+
+	// gives up after the retries
+	hook.Secret = "wrong"
+	attempts = 0
+	if err := webhooks.postRetrying(hook, WebhookEventRecorderError, body); err == nil {
+		t.Fatal("Expected an error with the wrong secret")
+	}
+
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRecorderErrorWebhook(t *testing.T) {
+	storage := newTestStorage(t, testDbName)
+
+	var events []WebhookPayload
+	webhooks := &Webhooks{
+		Storage: storage,
+		deliver: func(payload WebhookPayload) {
+			events = append(events, payload)
+		},
+	}
+	storage.OnFlush(webhooks.flushed)
+
+	var flushes []FlushEvent
+	storage.OnFlush(func(flush FlushEvent) {
+		flushes = append(flushes, flush)
+	})
+
+	writer := storage.NewBatchWriter(100, 0)
+	writer.written = storage.notifyFlush
+
+	if _, err := storage.db.Exec(`alter table keys rename to keys_moved`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// keys that keep failing to be written are reported once
+	for _, keys := range []int{1, 2} {
+		writer.WriteWindowKeys(keys, "kitty", "", "")
+	}
+	for i := 0; i < 3; i++ {
+		if err := writer.Flush(); err == nil {
+			t.Fatal("Expected an error writing to a missing table")
+		}
+	}
+
+	writer.WriteWindowKeys(4, "Firefox", "", "")
+	for i := 0; i < 3; i++ {
+		writer.Flush()
+	}
+
+	if len(events) != 2 || events[0].Event != WebhookEventRecorderError {
+		t.Fatalf("Expected two recorder errors, got %+v", events)
+	}
+
+	if events[0].Data.(RecorderError).Keys != 3 || events[1].Data.(RecorderError).Keys != 4 {
+		t.Fatalf("Unexpected recorder errors %+v", events)
+	}
+
+	if _, err := storage.db.Exec(`alter table keys_moved rename to keys`); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// once written every queued row is reported in a single flush
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(flushes) != 3 {
+		t.Fatalf("Expected 3 flushes, got %+v", flushes)
+	}
+
+	if last := flushes[2]; last.Err != nil || last.Keys != 7 || last.App != "" {
+		t.Fatalf("Unexpected flush %+v", last)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("Expected no more webhooks, got %+v", events)
+	}
+}